@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Baseline is a recorded set of dependencies, which the dependencies of the
+// roots may shrink from but not grow beyond. Baselines are stored as text,
+// one entry per line, starting with whether edges are recorded ("mode edges")
+// or not ("mode packages"):
+//
+//	# Comment
+//	mode edges
+//	root example.com/cmd/server
+//	package example.com/cmd/server
+//	package example.com/lib
+//	edge example.com/cmd/server example.com/lib
+type Baseline struct {
+	Roots    []Package
+	Packages Set
+	// The imports between packages, or nil if they are not recorded.
+	Edges Graph
+}
+
+// NewBaseline records the dependencies, optionally with their edges.
+func NewBaseline(d Dependencies, withEdges bool) *Baseline {
+	b := &Baseline{
+		Roots:    d.Roots,
+		Packages: NewSet(),
+	}
+	if withEdges {
+		b.Edges = NewGraph()
+	}
+	for pkg, imports := range d.Forward {
+		b.Packages.Insert(pkg)
+		if withEdges {
+			for imp := range imports {
+				b.Edges.Pkg(pkg).Insert(imp)
+			}
+		}
+	}
+	return b
+}
+
+// ReadBaseline reads a baseline written by Baseline.Write. Baselines without a
+// mode entry record edges if they have any edge entries.
+func ReadBaseline(r io.Reader) (*Baseline, error) {
+	b := &Baseline{Packages: NewSet()}
+	mode := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		switch {
+		case fields[0] == "mode" && len(fields) == 2 && mode == "" && (fields[1] == "edges" || fields[1] == "packages"):
+			mode = fields[1]
+			if mode == "edges" {
+				b.Edges = NewGraph()
+			}
+		case fields[0] == "root" && len(fields) == 2:
+			b.Roots = append(b.Roots, Package(fields[1]))
+		case fields[0] == "package" && len(fields) == 2:
+			b.Packages.Insert(Package(fields[1]))
+		case fields[0] == "edge" && len(fields) == 3 && mode != "packages":
+			if b.Edges == nil {
+				b.Edges = NewGraph()
+			}
+			b.Edges.Pkg(Package(fields[1])).Insert(Package(fields[2]))
+		default:
+			return nil, fmt.Errorf("invalid baseline entry on line %d: %q", line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Write writes the baseline in sorted order, so that changes to it are easy to
+// review.
+func (b *Baseline) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Dependency baseline, generated by godepq -update-baseline.")
+	if b.Edges != nil {
+		fmt.Fprintln(bw, "mode edges")
+	} else {
+		fmt.Fprintln(bw, "mode packages")
+	}
+	for _, root := range NewSet(b.Roots...).Sorted() {
+		fmt.Fprintf(bw, "root %s\n", root)
+	}
+	for _, pkg := range b.Packages.Sorted() {
+		fmt.Fprintf(bw, "package %s\n", pkg)
+	}
+	for _, pkg := range b.Edges.sortedPackages() {
+		for _, imp := range b.Edges[pkg].Sorted() {
+			fmt.Fprintf(bw, "edge %s %s\n", pkg, imp)
+		}
+	}
+	return bw.Flush()
+}
+
+// Check compares the dependencies with the baseline. Added packages, and added
+// edges if the baseline records them, break the baseline. Removals are allowed,
+// and are reported so that the baseline can be lowered.
+func (b *Baseline) Check(d Dependencies) *GraphDiff {
+	recorded := Dependencies{Forward: NewGraph()}
+	for pkg := range b.Packages {
+		recorded.Forward.Pkg(pkg)
+	}
+	for pkg, imports := range b.Edges {
+		for imp := range imports {
+			recorded.Forward.Pkg(pkg).Insert(imp)
+		}
+	}
+	current := d
+	if b.Edges == nil {
+		// Only compare the packages.
+		current = Dependencies{Forward: NewGraph()}
+		for pkg := range d.Forward {
+			current.Forward.Pkg(pkg)
+		}
+	}
+	return Diff(recorded, current)
+}
@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/build/constraint"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CacheableLoader is implemented by Loaders which read each package from a
+// single directory with a build context, so that the packages they load can
+// be cached.
+type CacheableLoader interface {
+	Loader
+	// Find resolves the import path like Load, without reading the package's
+	// files. Only the ImportPath and Dir of the result are used.
+	Find(importPath, srcDir string) (*build.Package, error)
+	// LoadFound reads the package returned by Find, without resolving its
+	// import path again.
+	LoadFound(found *build.Package) (*LoadedPackage, error)
+	// BuildContext returns the context packages are loaded with.
+	BuildContext() build.Context
+}
+
+func (l *BuildLoader) Find(importPath, srcDir string) (*build.Package, error) {
+	return l.Context.Import(importPath, srcDir, build.FindOnly)
+}
+
+func (l *BuildLoader) LoadFound(found *build.Package) (*LoadedPackage, error) {
+	return loadFound(l.Context, found)
+}
+
+func (l *BuildLoader) BuildContext() build.Context {
+	return l.Context
+}
+
+func (l *ModuleLoader) Find(importPath, srcDir string) (*build.Package, error) {
+	return l.Modules.Import(importPath, srcDir, l.Context, build.FindOnly)
+}
+
+func (l *ModuleLoader) LoadFound(found *build.Package) (*LoadedPackage, error) {
+	pkg, err := loadFound(l.Context, found)
+	if err != nil {
+		return nil, err
+	}
+	resolveStdVendor(pkg, l.Context)
+	return pkg, nil
+}
+
+func (l *ModuleLoader) BuildContext() build.Context {
+	return l.Context
+}
+
+// loadFound reads the package in the directory found, keeping the import path
+// it was found by, which for vendored packages differs from the directory.
+func loadFound(ctx build.Context, found *build.Package) (*LoadedPackage, error) {
+	pkg, err := ctx.ImportDir(found.Dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	pkg.ImportPath = found.ImportPath
+	return newLoadedPackage(pkg), nil
+}
+
+// Cache stores the data a Builder reads from each package's files in a
+// directory, so that packages which have not changed are not parsed again.
+// Entries are keyed by the package's directory, the names of the files in it,
+// the contents of its Go files, and the build context. The contents are
+// hashed rather than trusting modification times, which may be too coarse to
+// tell edits apart, so hits still read the files but do not parse them.
+// Entries which no longer match any package are never removed; the directory
+// may be deleted at any time.
+type Cache struct {
+	Dir string
+}
+
+// cacheVersion is included in the keys, so that changes to the format of the
+// entries do not read old ones.
+const cacheVersion = "3"
+
+// cacheEntry is the data of a package stored in a Cache.
+type cacheEntry struct {
+	Package     *LoadedPackage
+	LOC         int
+	Positions   map[string][]ImportPos `json:",omitempty"`
+	Constraints map[string]string      `json:",omitempty"`
+}
+
+// key returns the key of the package with the files in dir, or "" if the
+// files can not be read.
+func (c *Cache) key(importPath, dir string, tests bool, ctx build.Context) string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, cacheVersion, importPath, dir, tests)
+	fmt.Fprintln(h, ctx.GOOS, ctx.GOARCH, ctx.GOROOT, ctx.GOPATH, ctx.CgoEnabled, ctx.Compiler, ctx.InstallSuffix)
+	fmt.Fprintln(h, ctx.BuildTags, ctx.ToolTags, ctx.ReleaseTags)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		fmt.Fprintln(h, f.Name(), f.Size())
+		if filepath.Ext(f.Name()) != ".go" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return ""
+		}
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".json")
+}
+
+// get returns the cached result for the key, or nil if there is none.
+func (c *Cache) get(key string) *loadResult {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Package == nil {
+		return nil
+	}
+	r := &loadResult{
+		pkg:       entry.Package,
+		loc:       entry.LOC,
+		positions: entry.Positions,
+	}
+	for imp, s := range entry.Constraints {
+		x, err := constraint.Parse("//go:build " + s)
+		if err != nil {
+			return nil
+		}
+		if r.constraints == nil {
+			r.constraints = make(map[string]constraint.Expr)
+		}
+		r.constraints[imp] = x
+	}
+	return r
+}
+
+// put stores the result for the key. The entry is written to a temporary
+// file first, so that concurrent builds never read a partial entry.
+func (c *Cache) put(key string, r *loadResult) error {
+	pkg := *r.pkg
+	// The positions are stored relative to the package's directory instead.
+	pkg.ImportPos, pkg.TestImportPos, pkg.XTestImportPos = nil, nil, nil
+	entry := cacheEntry{Package: &pkg, LOC: r.loc, Positions: r.positions}
+	for imp, x := range r.constraints {
+		if x == nil {
+			continue
+		}
+		if entry.Constraints == nil {
+			entry.Constraints = make(map[string]string)
+		}
+		entry.Constraints[imp] = x.String()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// importConstraints parses the Go files of the package, including files
+// excluded by the build context, and returns the build constraint under which
+// each import is imported. Imports in any file without constraints are
+// unconditional, and are mapped to nil. Constraints include the file name
+// suffixes, and cgo for files importing "C". Excluded files which can only be
+// built with the "ignore" tag, such as programs run by go generate, are
+// skipped.
+func importConstraints(pkg *LoadedPackage, includeTests bool) map[string]constraint.Expr {
+	files := append([]string{}, pkg.GoFiles...)
+	files = append(files, pkg.CgoFiles...)
+	if includeTests {
+		files = append(files, pkg.TestGoFiles...)
+		files = append(files, pkg.XTestGoFiles...)
+	}
+	excluded := make(map[string]bool)
+	for _, file := range pkg.IgnoredGoFiles {
+		if includeTests || !strings.HasSuffix(file, "_test.go") {
+			files = append(files, file)
+			excluded[file] = true
+		}
+	}
+	sort.Strings(files)
+
+	exprs := make(map[string][]constraint.Expr)
+	unconditional := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, file := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, file), nil, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			// Excluded files need not be valid Go.
+			continue
+		}
+		var imports []string
+		var cgo bool
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			if path == "C" {
+				cgo = true
+			}
+			imports = append(imports, path)
+		}
+
+		var expr constraint.Expr
+		and := func(x constraint.Expr) {
+			if expr == nil {
+				expr = x
+			} else {
+				expr = &constraint.AndExpr{X: expr, Y: x}
+			}
+		}
+		var goBuild, plusBuild constraint.Expr
+		for i, group := range f.Comments {
+			if group.Pos() >= f.Package {
+				break
+			}
+			// As in go/build, constraints must be followed by a blank line, so
+			// that they are not part of the package's doc comment.
+			next := f.Package
+			if i+1 < len(f.Comments) && f.Comments[i+1].Pos() < next {
+				next = f.Comments[i+1].Pos()
+			}
+			if fset.Position(next).Line <= fset.Position(group.End()).Line+1 {
+				continue
+			}
+			for _, c := range group.List {
+				x, err := constraint.Parse(c.Text)
+				switch {
+				case err != nil:
+				case constraint.IsGoBuild(c.Text):
+					goBuild = x
+				case plusBuild == nil:
+					plusBuild = x
+				default:
+					plusBuild = &constraint.AndExpr{X: plusBuild, Y: x}
+				}
+			}
+		}
+		if goBuild != nil {
+			and(goBuild)
+		} else if plusBuild != nil {
+			and(plusBuild)
+		}
+		if expr != nil && excluded[file] && onlyIgnored(expr) {
+			continue
+		}
+		if x := fileNameConstraint(file); x != nil {
+			and(x)
+		}
+		if cgo {
+			and(&constraint.TagExpr{Tag: "cgo"})
+		}
+
+		for _, imp := range imports {
+			if expr == nil {
+				unconditional[imp] = true
+			} else {
+				exprs[imp] = append(exprs[imp], expr)
+			}
+		}
+	}
+
+	constraints := make(map[string]constraint.Expr)
+	for imp := range unconditional {
+		constraints[imp] = nil
+	}
+	for imp, xs := range exprs {
+		if unconditional[imp] {
+			continue
+		}
+		// Terms repeated in the constraints of several files are only
+		// included once.
+		var expr constraint.Expr
+		seen := make(map[string]bool)
+		for _, x := range xs {
+			for _, term := range orTerms(x) {
+				if seen[term.String()] {
+					continue
+				}
+				seen[term.String()] = true
+				if expr == nil {
+					expr = term
+				} else {
+					expr = &constraint.OrExpr{X: expr, Y: term}
+				}
+			}
+		}
+		constraints[imp] = expr
+	}
+	return constraints
+}
+
+// orTerms returns the terms of x if it is a disjunction, or else x.
+func orTerms(x constraint.Expr) []constraint.Expr {
+	if or, ok := x.(*constraint.OrExpr); ok {
+		return append(orTerms(or.X), orTerms(or.Y)...)
+	}
+	return []constraint.Expr{x}
+}
+
+// onlyIgnored reports whether the constraint can only be satisfied with the
+// "ignore" tag, which by convention is never set. Constraints with too many
+// tags to check are assumed satisfiable.
+func onlyIgnored(x constraint.Expr) bool {
+	var tags []string
+	seen := map[string]bool{"ignore": true}
+	hasIgnore := false
+	x.Eval(func(tag string) bool {
+		if tag == "ignore" {
+			hasIgnore = true
+		} else if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		return false
+	})
+	if !hasIgnore || len(tags) > 16 {
+		return false
+	}
+	for set := 0; set < 1<<uint(len(tags)); set++ {
+		ok := x.Eval(func(tag string) bool {
+			for i, t := range tags {
+				if t == tag {
+					return set&(1<<uint(i)) != 0
+				}
+			}
+			return false
+		})
+		if ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fileNameConstraint returns the constraint implied by the GOOS and GOARCH
+// suffixes of the file name, such as "linux && amd64" for "f_linux_amd64.go",
+// or nil if there are none.
+func fileNameConstraint(file string) constraint.Expr {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".go"), "_test")
+	if i := strings.Index(name, "_"); i >= 0 {
+		name = name[i:]
+	} else {
+		return nil
+	}
+	parts := strings.Split(name, "_")
+	n := len(parts)
+	if n >= 2 && knownOS[parts[n-2]] && knownArch[parts[n-1]] {
+		return &constraint.AndExpr{
+			X: &constraint.TagExpr{Tag: parts[n-2]},
+			Y: &constraint.TagExpr{Tag: parts[n-1]},
+		}
+	}
+	if knownOS[parts[n-1]] || knownArch[parts[n-1]] {
+		return &constraint.TagExpr{Tag: parts[n-1]}
+	}
+	return nil
+}
+
+// knownOS and knownArch are the file name suffixes go/build recognises.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+		"hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true,
+		"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true,
+		"arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true,
+		"mips64le": true, "mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true, "s390x": true,
+		"sparc": true, "sparc64": true, "wasm": true,
+	}
+)
@@ -13,25 +13,133 @@ import (
 	"errors"
 	"fmt"
 	"go/build"
+	"go/build/constraint"
+	"go/token"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type Dependencies struct {
+	// The included root packages, with patterns expanded.
+	Roots []Package
 	// Map of package -> dependencies.
 	Forward Graph
+	// Map of package -> packages which depend on it.
+	Reverse Graph
 	// Packages which were ignored.
 	Ignored Set
 	Info    map[Package]*DependencyInfo
+	// Metadata of the imports in Forward, if known.
+	EdgeInfo map[Edge]*EdgeInfo
 }
 
 type DependencyInfo struct {
+	// Lines of code in the package.
 	LOC int
-	// TODO: Add recursive LOC (but don't double count packages)
+	// Lines of code in the package and all of its dependencies, counting each
+	// package once.
+	TransitiveLOC int
+	// Lines of code in the packages the package dominates, which are only
+	// reachable from the roots through it, and would be dropped if nothing
+	// imported it. EdgeInfo.ExclusiveLOC is the code dropped by removing a
+	// single import.
+	ExclusiveLOC int
+	// Whether the package is in the standard library.
+	Stdlib bool
+	// Whether the package is only reachable from the roots through test
+	// imports.
+	TestOnly bool
+}
+
+// EdgeInfo is the metadata of an import of one package by another.
+type EdgeInfo struct {
+	// The positions of the import specs, sorted.
+	Positions []ImportPos
+	// The symbols of the imported package used by the importer, if they were
+	// loaded with a SymbolLoader.
+	Symbols []SymbolUse
+	// The build constraint under which the package is imported, in
+	// //go:build syntax, or "" if it is imported unconditionally.
+	Constraint string
+	// Which files of the importer make the import.
+	Kind EdgeKind
+	// Lines of code which would be dropped from the graph if this import were
+	// removed.
+	ExclusiveLOC int
+}
+
+// EdgeKind is the kind of files an import is made from. An import made by
+// several kinds of files has the first of them, in the order below.
+type EdgeKind int
+
+const (
+	// ProdEdge is an import by the package's non-test files.
+	ProdEdge EdgeKind = iota
+	// TestEdge is an import by the package's internal test files, which are
+	// compiled with the package.
+	TestEdge
+	// XTestEdge is an import by the package's external test files, in the
+	// separate _test package.
+	XTestEdge
+)
+
+var edgeKinds = []string{"prod", "test", "xtest"}
+
+func (k EdgeKind) String() string {
+	if k < 0 || int(k) >= len(edgeKinds) {
+		return fmt.Sprintf("EdgeKind(%d)", int(k))
+	}
+	return edgeKinds[k]
+}
+
+func (k EdgeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *EdgeKind) UnmarshalText(text []byte) error {
+	for i, name := range edgeKinds {
+		if string(text) == name {
+			*k = EdgeKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid edge kind %q", text)
+}
+
+// ImportPos is the position of an import spec, encoded as "file:line".
+type ImportPos struct {
+	// The name of the file, relative to the importing package's directory.
+	File string
+	Line int
+}
+
+func (p ImportPos) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+func (p ImportPos) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *ImportPos) UnmarshalText(text []byte) error {
+	s := string(text)
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return fmt.Errorf("invalid import position %q", s)
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return fmt.Errorf("invalid import position %q", s)
+	}
+	p.File, p.Line = s[:i], line
+	return nil
 }
 
 type Condition func(Dependencies) bool
@@ -50,7 +158,8 @@ func Resolve(importPath, basePath string, bctx build.Context) (Package, error) {
 type Builder struct {
 	// The base directory for relative imports.
 	BaseDir string
-	// The roots of the dependency graph (source packages).
+	// The roots of the dependency graph (source packages). Roots may be
+	// patterns such as "./..." if the Loader implements Expander.
 	Roots []Package
 	// Stop building the graph if ANY conditions are met.
 	TerminationConditions []Condition
@@ -62,85 +171,203 @@ type Builder struct {
 	Included []*regexp.Regexp
 	// Whether tests should be included in the dependencies.
 	IncludeTests bool
+	// Whether only the tests of the roots are included, if IncludeTests is
+	// set. Beyond the roots, only production imports are followed.
+	RootTestsOnly bool
 	// Whether to include standard library packages
 	IncludeStdlib bool
 	// The build context for processing imports.
+	// Only used if Loader is nil.
 	BuildContext build.Context
+	// The loader for package import data.
+	// If nil, packages are loaded from BuildContext.
+	Loader Loader
+	// The number of packages to load concurrently. If less than 2, packages
+	// are loaded one at a time. The graph is the same either way, but more
+	// packages may be loaded when a termination condition is met.
+	Jobs int
+	// The cache for the data read from packages' files. Only used if the
+	// Loader is a CacheableLoader.
+	Cache *Cache
 
 	// Internal
 	deps Dependencies
+	// The non-test imports of each package.
+	prodImports Graph
+	// The packages whose test imports have been followed.
+	testsAdded Set
+	// The packages loaded so far, keyed by the import path they were loaded
+	// with.
+	loaded map[loadKey]*loadResult
+}
+
+// loadKey identifies a package to load: its import path as imported, and
+// whether its tests are included.
+type loadKey struct {
+	name  Package
+	tests bool
+}
+
+// loadResult is a loaded package, with the data the Builder reads from its
+// files if it is accepted.
+type loadResult struct {
+	pkg      *LoadedPackage
+	err      error
+	accepted bool
+
+	loc         int
+	positions   map[string][]ImportPos
+	constraints map[string]constraint.Expr
+	// Errors reading the files, which are logged rather than failing the
+	// build.
+	fileErrs []error
 }
 
 func (b *Builder) Build() (Dependencies, error) {
 	b.deps = Dependencies{
-		Forward: NewGraph(),
-		Ignored: NewSet(),
-		Info:    make(map[Package]*DependencyInfo),
+		Forward:  NewGraph(),
+		Reverse:  NewGraph(),
+		Ignored:  NewSet(),
+		Info:     make(map[Package]*DependencyInfo),
+		EdgeInfo: make(map[Edge]*EdgeInfo),
 	}
+	b.prodImports = NewGraph()
+	b.testsAdded = NewSet()
+	b.loaded = make(map[loadKey]*loadResult)
 
 	err := b.addAllPackages(b.Roots)
 	if err == termination {
 		err = nil // Ignore termination condition.
 	}
+	if err == nil {
+		b.addTransitiveLOC()
+		idom := b.addExclusiveLOC()
+		b.addEdgeExclusiveLOC(idom)
+		b.markTestOnly()
+	}
 
 	return b.deps, err
 }
 
 func (b *Builder) addAllPackages(pkgs []Package) error {
+	var roots []Package
 	for _, pkg := range pkgs {
-		// TODO: add support for recursive sub-packages.
-		includedName, err := b.addPackage(pkg)
+		expanded, err := b.expand(pkg)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, expanded...)
+	}
+	if b.Jobs > 1 {
+		b.prefetch(roots)
+	}
+
+	added := NewSet()
+	for _, root := range roots {
+		includedName, err := b.addPackage(root, true)
+		if includedName != "" && !added.Has(includedName) {
+			added.Insert(includedName)
+			b.deps.Roots = append(b.deps.Roots, includedName)
+		}
 		if err != nil {
 			return err
 		}
 		if includedName == "" {
-			fmt.Fprintf(os.Stderr, "Warning: ignoring root package %q\n", pkg)
+			fmt.Fprintf(os.Stderr, "Warning: ignoring root package %q\n", root)
 		}
 	}
 	return nil
 }
 
+// expand returns the packages matching pkg if it is a pattern, or else pkg.
+func (b *Builder) expand(pkg Package) ([]Package, error) {
+	if !IsPattern(string(pkg)) {
+		return []Package{pkg}, nil
+	}
+	expander, ok := b.loader().(Expander)
+	if !ok {
+		return nil, fmt.Errorf("unable to expand %q: loader does not support patterns", pkg)
+	}
+	matches, err := expander.Expand(string(pkg), b.BaseDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand %q: %v", pkg, err)
+	}
+	if len(matches) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %q matched no packages\n", pkg)
+	}
+	var pkgs []Package
+	for _, m := range matches {
+		pkgs = append(pkgs, Package(m))
+	}
+	return pkgs, nil
+}
+
 var termination = errors.New("termination condition met")
 
 // Recursively adds a package to the accumulated dependency graph.
 // If the package is not included, includedName will be empty.
-func (b *Builder) addPackage(pkgName Package) (includedName Package, err error) {
+func (b *Builder) addPackage(pkgName Package, root bool) (includedName Package, err error) {
 	// Ignore cgo imports
 	if pkgName == "C" {
 		return "", nil
 	}
 
-	pkg, err := b.BuildContext.Import(string(pkgName), b.BaseDir, 0)
-	if err != nil {
-		return "", err
+	tests := b.IncludeTests && (root || !b.RootTestsOnly)
+	loaded := b.load(loadKey{pkgName, tests})
+	if loaded.err != nil {
+		return "", loaded.err
 	}
+	pkg := loaded.pkg
 
 	pkgFullName := stripVendor(pkg.ImportPath)
-	if !b.isAccepted(pkg) {
+	if !loaded.accepted {
 		b.deps.Ignored.Insert(pkgFullName)
 		return "", nil
 	}
 
 	if b.deps.Forward.Has(pkgFullName) {
-		// Package was included, but we don't need to walk its deps again.
-		return pkgFullName, nil
-	}
-
-	// Insert the package.
-	b.deps.Forward.Pkg(pkgFullName)
-
-	b.deps.Info[pkgFullName] = &DependencyInfo{
-		LOC: b.linesOfCode(pkg),
-	}
+		if !tests || b.testsAdded.Has(pkgFullName) {
+			// Package was included, but we don't need to walk its deps again.
+			return pkgFullName, nil
+		}
+		// A root which was first reached as an import of another package:
+		// its test imports still need to be walked.
+		b.deps.Info[pkgFullName].LOC = loaded.loc
+	} else {
+		// Insert the package.
+		b.deps.Forward.Pkg(pkgFullName)
+		b.deps.Reverse.Pkg(pkgFullName)
+
+		b.deps.Info[pkgFullName] = &DependencyInfo{
+			LOC:    loaded.loc,
+			Stdlib: pkg.Standard,
+		}
 
-	for _, condition := range b.TerminationConditions {
-		if condition(b.deps) {
-			return pkgFullName, termination
+		for _, condition := range b.TerminationConditions {
+			if condition(b.deps) {
+				return pkgFullName, termination
+			}
 		}
 	}
+	if tests {
+		b.testsAdded.Insert(pkgFullName)
+	}
+	for _, err := range loaded.fileErrs {
+		log.Printf("ERROR: %v", err)
+	}
 
-	for _, imp := range b.getImports(pkg) {
-		includedName, err := b.addPackage(imp)
+	kinds := make(map[string]EdgeKind)
+	for _, imp := range pkg.XTestImports {
+		kinds[imp] = XTestEdge
+	}
+	for _, imp := range pkg.TestImports {
+		kinds[imp] = TestEdge
+	}
+	for _, imp := range pkg.Imports {
+		kinds[imp] = ProdEdge
+	}
+	for _, imp := range b.getImports(pkg, tests) {
+		includedName, err := b.addPackage(imp, false)
 		if err != nil {
 			return pkgFullName, err
 		}
@@ -150,14 +377,173 @@ func (b *Builder) addPackage(pkgName Package) (includedName Package, err error)
 		}
 
 		b.deps.Forward.Pkg(pkgFullName).Insert(includedName)
+		b.deps.Reverse.Pkg(includedName).Insert(pkgFullName)
+		info := &EdgeInfo{Positions: loaded.positions[string(imp)], Kind: kinds[string(imp)]}
+		if x := loaded.constraints[string(imp)]; x != nil {
+			info.Constraint = x.String()
+		}
+		if len(info.Positions) > 0 || info.Constraint != "" || info.Kind != ProdEdge {
+			b.deps.EdgeInfo[Edge{pkgFullName, includedName}] = info
+		}
+		if info.Kind == ProdEdge {
+			b.prodImports.Pkg(pkgFullName).Insert(includedName)
+		}
 	}
 
 	return pkgFullName, nil
 }
 
-func (b *Builder) getImports(pkg *build.Package) []Package {
+// load returns the package loaded with the key, loading it if it was not
+// prefetched.
+func (b *Builder) load(key loadKey) *loadResult {
+	if r := b.loaded[key]; r != nil {
+		return r
+	}
+	r := b.loadPackage(key)
+	b.loaded[key] = r
+	return r
+}
+
+// loadPackage loads a package and, if it is accepted, reads its lines of code
+// and the positions and constraints of its imports. It does not modify the
+// Builder, so several packages may be loaded at once.
+func (b *Builder) loadPackage(key loadKey) *loadResult {
+	cacheKey, found := b.cacheKey(key)
+	if cacheKey != "" {
+		if r := b.Cache.get(cacheKey); r != nil {
+			r.accepted = b.isAccepted(r.pkg)
+			return r
+		}
+	}
+
+	var pkg *LoadedPackage
+	var err error
+	if found != nil {
+		pkg, err = b.loader().(CacheableLoader).LoadFound(found)
+	} else {
+		pkg, err = b.loader().Load(string(key.name), b.BaseDir)
+	}
+	if err != nil {
+		return &loadResult{err: err}
+	}
+	r := &loadResult{pkg: pkg, accepted: b.isAccepted(pkg)}
+	if !r.accepted {
+		return r
+	}
+	r.loc, r.fileErrs = b.linesOfCode(pkg, key.tests)
+	if r.positions, err = b.importPositions(pkg, key.tests); err != nil {
+		r.fileErrs = append(r.fileErrs, err)
+	}
+	if !pkg.NoSources && pkg.Dir != "" {
+		r.constraints = importConstraints(pkg, key.tests)
+	}
+	resolveImportKeys(pkg, r.positions, r.constraints)
+	if cacheKey != "" && len(r.fileErrs) == 0 {
+		if err := b.Cache.put(cacheKey, r); err != nil {
+			r.fileErrs = append(r.fileErrs, fmt.Errorf("unable to cache %q: %v", key.name, err))
+		}
+	}
+	return r
+}
+
+// cacheKey returns the key of the package in the Cache, or "" if it can not
+// be cached. The package found is also returned, so that it is not resolved
+// again if it must be loaded.
+func (b *Builder) cacheKey(key loadKey) (string, *build.Package) {
+	loader, ok := b.loader().(CacheableLoader)
+	if b.Cache == nil || !ok {
+		return "", nil
+	}
+	found, err := loader.Find(string(key.name), b.BaseDir)
+	if err != nil || found.Dir == "" {
+		return "", nil
+	}
+	return b.Cache.key(found.ImportPath, found.Dir, key.tests, loader.BuildContext()), found
+}
+
+// prefetch loads the packages reachable from the roots with a pool of Jobs
+// workers. The graph is then built by the same serial walk as without
+// prefetching, which finds the packages loaded, so the results do not depend
+// on the order the loads finish in. Each package is only loaded once, however
+// many packages import it.
+func (b *Builder) prefetch(roots []Package) {
+	// Set the default loader before it is shared.
+	b.loader()
+
+	var (
+		mu   sync.Mutex
+		cond = sync.NewCond(&mu)
+		// Packages waiting to be loaded.
+		queue []loadKey
+		// The number of packages queued or being loaded.
+		pending int
+	)
+	enqueue := func(key loadKey) {
+		if _, ok := b.loaded[key]; ok || key.name == "C" {
+			return
+		}
+		// Mark the package as in flight, so that it is only queued once.
+		b.loaded[key] = nil
+		queue = append(queue, key)
+		pending++
+		cond.Signal()
+	}
+	mu.Lock()
+	for _, root := range roots {
+		enqueue(loadKey{root, b.IncludeTests})
+	}
+	mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < b.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			for {
+				for len(queue) == 0 && pending > 0 {
+					cond.Wait()
+				}
+				if pending == 0 {
+					return
+				}
+				key := queue[0]
+				queue = queue[1:]
+
+				mu.Unlock()
+				r := b.loadPackage(key)
+				mu.Lock()
+
+				b.loaded[key] = r
+				if r.err == nil && r.accepted {
+					for _, imp := range b.getImports(r.pkg, key.tests) {
+						enqueue(loadKey{imp, b.IncludeTests && !b.RootTestsOnly})
+					}
+				}
+				pending--
+				if pending == 0 {
+					// Wake the idle workers, so that they exit.
+					cond.Broadcast()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *Builder) loader() Loader {
+	if b.Loader == nil {
+		b.Loader = &BuildLoader{Context: b.BuildContext}
+	}
+	return b.Loader
+}
+
+// getImports returns the imports of the package, including test imports if
+// tests is set.
+func (b *Builder) getImports(pkg *LoadedPackage, tests bool) []Package {
 	allImports := pkg.Imports
-	if b.IncludeTests {
+	if tests {
 		allImports = append(allImports, pkg.TestImports...)
 		allImports = append(allImports, pkg.XTestImports...)
 	}
@@ -177,6 +563,63 @@ func (b *Builder) getImports(pkg *build.Package) []Package {
 	return imports
 }
 
+// importPositions returns the sorted positions of the import specs of each
+// import of the package, including test imports if tests is set.
+func (b *Builder) importPositions(pkg *LoadedPackage, tests bool) (map[string][]ImportPos, error) {
+	prodPos, testPos, xtestPos, err := pkg.importPositions()
+	if err != nil {
+		return nil, err
+	}
+	importPos := []map[string][]token.Position{prodPos}
+	if tests {
+		importPos = append(importPos, testPos, xtestPos)
+	}
+	positions := make(map[string][]ImportPos)
+	for _, m := range importPos {
+		for imp, pos := range m {
+			for _, p := range pos {
+				file, err := filepath.Rel(pkg.Dir, p.Filename)
+				if err != nil {
+					file = p.Filename
+				}
+				positions[imp] = append(positions[imp], ImportPos{filepath.ToSlash(file), p.Line})
+			}
+		}
+	}
+	for _, pos := range positions {
+		sort.Slice(pos, func(i, j int) bool {
+			if pos[i].File != pos[j].File {
+				return pos[i].File < pos[j].File
+			}
+			return pos[i].Line < pos[j].Line
+		})
+	}
+	return positions, nil
+}
+
+// resolveImportKeys re-keys the positions and constraints of the package's
+// imports, which are parsed from its files by the import paths written there,
+// by the resolved import paths the loader reported, such as
+// "example.com/p/vendor/example.com/q" or "vendor/golang.org/x/net/dns".
+func resolveImportKeys(pkg *LoadedPackage, positions map[string][]ImportPos, constraints map[string]constraint.Expr) {
+	for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+		for _, imp := range imports {
+			source := strings.TrimPrefix(string(stripVendor(imp)), "vendor/")
+			if source == imp {
+				continue
+			}
+			if pos, ok := positions[source]; ok {
+				positions[imp] = pos
+				delete(positions, source)
+			}
+			if x, ok := constraints[source]; ok {
+				constraints[imp] = x
+				delete(constraints, source)
+			}
+		}
+	}
+}
+
 func (b *Builder) isIgnored(pkg Package) bool {
 	for _, r := range b.Ignored {
 		if r.MatchString(string(pkg)) {
@@ -199,12 +642,12 @@ func (b *Builder) isIncluded(pkg Package) bool {
 }
 
 // Detects if package name matches search criterias
-func (b *Builder) isAccepted(pkg *build.Package) bool {
+func (b *Builder) isAccepted(pkg *LoadedPackage) bool {
 	pkgFullName := stripVendor(pkg.ImportPath)
 	if b.isIgnored(pkgFullName) {
 		return false
 	}
-	if pkg.Goroot && !b.IncludeStdlib {
+	if pkg.Standard && !b.IncludeStdlib {
 		return false
 	}
 	return b.isIncluded(pkgFullName)
@@ -223,24 +666,147 @@ func stripVendor(pkg string) Package {
 	return Package(pkg)
 }
 
-func (b *Builder) linesOfCode(pkg *build.Package) int {
+// linesOfCode returns the lines of code of the package's files, including test
+// files if tests is set, and the errors reading any of them.
+func (b *Builder) linesOfCode(pkg *LoadedPackage, tests bool) (int, []error) {
 	loc := 0
+	var errs []error
 	files := append([]string{}, pkg.GoFiles...)
 	// TODO: Should we also include the c source files?
 	files = append(files, pkg.CgoFiles...)
-	if b.IncludeTests {
+	if tests {
 		files = append(files, pkg.TestGoFiles...)
 		files = append(files, pkg.XTestGoFiles...)
 	}
 	for _, f := range files {
+		if l, ok := pkg.FileLOC[f]; ok || pkg.NoSources {
+			loc += l
+			continue
+		}
 		l, err := countLines(filepath.Join(pkg.Dir, f))
 		if err != nil {
-			log.Printf("ERROR: %v", err)
+			errs = append(errs, err)
 			continue
 		}
 		loc += l
 	}
-	return loc
+	return loc, errs
+}
+
+// addTransitiveLOC sums the lines of code of the packages reachable from each
+// package. Packages in a cycle reach the same packages, so the sums are
+// computed over the strongly connected components.
+func (b *Builder) addTransitiveLOC() {
+	components := b.deps.Forward.stronglyConnected()
+	componentOf := make(map[Package]int, len(b.deps.Forward))
+	for i, component := range components {
+		for _, pkg := range component {
+			componentOf[pkg] = i
+		}
+	}
+
+	// reaches[i] is the set of components reachable from component i, as a
+	// bitset. Components are in reverse topological order, so the components
+	// they import have already been computed.
+	words := (len(components) + 63) / 64
+	reaches := make([][]uint64, len(components))
+	componentLOC := make([]int, len(components))
+	for i, component := range components {
+		reaches[i] = make([]uint64, words)
+		reaches[i][i/64] |= 1 << uint(i%64)
+		for _, pkg := range component {
+			componentLOC[i] += b.deps.Info[pkg].LOC
+			for imp := range b.deps.Forward[pkg] {
+				for w, bits := range reaches[componentOf[imp]] {
+					reaches[i][w] |= bits
+				}
+			}
+		}
+
+		loc := 0
+		for j := range components {
+			if reaches[i][j/64]&(1<<uint(j%64)) != 0 {
+				loc += componentLOC[j]
+			}
+		}
+		for _, pkg := range component {
+			b.deps.Info[pkg].TransitiveLOC = loc
+		}
+	}
+}
+
+// addExclusiveLOC sums the lines of code of the packages dominated by each
+// package: those which can only be reached from the roots through it. The
+// immediate dominators are returned.
+func (b *Builder) addExclusiveLOC() map[Package]Package {
+	idom, order := b.deps.Forward.dominators(b.deps.Roots)
+	for _, pkg := range order {
+		b.deps.Info[pkg].ExclusiveLOC = b.deps.Info[pkg].LOC
+	}
+	// Every package comes after its dominator, so visiting them in reverse
+	// adds each package's total to its dominator once it is complete.
+	for i := len(order) - 1; i >= 0; i-- {
+		pkg := order[i]
+		if dom := idom[pkg]; dom != NullPackage {
+			b.deps.Info[dom].ExclusiveLOC += b.deps.Info[pkg].ExclusiveLOC
+		}
+	}
+	return idom
+}
+
+// addEdgeExclusiveLOC sets the lines of code dropped by removing each import.
+// Removing an import only drops code if every path from the roots to the
+// imported package goes through it, and then drops the packages the imported
+// package dominates. That is the case when the imported package is not a root,
+// and the importer is its only importer which it does not dominate itself.
+func (b *Builder) addEdgeExclusiveLOC(idom map[Package]Package) {
+	dominates := func(dom, pkg Package) bool {
+		for ; pkg != NullPackage; pkg = idom[pkg] {
+			if pkg == dom {
+				return true
+			}
+		}
+		return false
+	}
+	roots := NewSet(b.deps.Roots...)
+	for pkg, importers := range b.deps.Reverse {
+		if roots.Has(pkg) {
+			continue
+		}
+		var from Package
+		count := 0
+		for importer := range importers {
+			if _, ok := idom[importer]; ok && !dominates(pkg, importer) {
+				from = importer
+				count++
+			}
+		}
+		if count != 1 || b.deps.Info[pkg].ExclusiveLOC == 0 {
+			continue
+		}
+		e := Edge{from, pkg}
+		info, ok := b.deps.EdgeInfo[e]
+		if !ok {
+			info = &EdgeInfo{}
+			b.deps.EdgeInfo[e] = info
+		}
+		info.ExclusiveLOC = b.deps.Info[pkg].ExclusiveLOC
+	}
+}
+
+// markTestOnly marks the packages which can not be reached from the roots
+// without following a test import.
+func (b *Builder) markTestOnly() {
+	prod := NewSet()
+	for _, root := range b.deps.Roots {
+		for pkg := range b.prodImports.Reachable(root, 0) {
+			prod.Insert(pkg)
+		}
+		prod.Insert(root)
+	}
+	for pkg, info := range b.deps.Info {
+		info.TestOnly = !prod.Has(pkg)
+	}
 }
 
 func countLines(file string) (int, error) {
@@ -9,11 +9,22 @@ https://opensource.org/licenses/MIT.
 package deps
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
@@ -55,10 +66,34 @@ func testBuildBasic(t *testing.T, includeStdlib, includeTests bool) Dependencies
 		IncludeTests:  includeTests,
 	}).Build()
 	assert.NoError(t, err)
-	assertGraphsEqual(t, deps.Forward, expectedGraph(includeStdlib, includeTests))
+	expected := expectedGraph(includeStdlib, includeTests)
+	forward, reverse := deps.Forward, deps.Reverse
+	if includeStdlib {
+		// The imports of the standard library vary between Go versions.
+		forward, reverse = restrict(forward, expected), restrict(reverse, expected)
+	}
+	assertGraphsEqual(t, forward, expected)
+	assertGraphsEqual(t, reverse, invert(expected))
 	return deps
 }
 
+// restrict returns the subgraph of g with the packages in pkgs.
+func restrict(g Graph, pkgs Graph) Graph {
+	sub := NewGraph()
+	for pkg, imports := range g {
+		if !pkgs.Has(pkg) {
+			continue
+		}
+		sub.Pkg(pkg)
+		for imp := range imports {
+			if pkgs.Has(imp) {
+				sub.Pkg(pkg).Insert(imp)
+			}
+		}
+	}
+	return sub
+}
+
 func TestIgnoreBasic(t *testing.T) {
 	deps, err := (&Builder{
 		Roots:        []Package{Package(basePkg)},
@@ -147,6 +182,384 @@ func expectedGraph(includeStdlib, includeTests bool) Graph {
 	return expected
 }
 
+func invert(g Graph) Graph {
+	inverted := NewGraph()
+	for pkg, imports := range g {
+		inverted.Pkg(pkg)
+		for imp := range imports {
+			inverted.Pkg(imp).Insert(pkg)
+		}
+	}
+	return inverted
+}
+
+func TestReachable(t *testing.T) {
+	reverse := invert(expectedGraph(false, true))
+
+	// Packages which depend on c, directly.
+	expected := NewGraph()
+	for _, pkg := range []string{"a", "a/aa", "a/aa/aaa", "a/ab", "b", "b/ba"} {
+		expected.Pkg(mkpkg("c")).Insert(mkpkg(pkg))
+		expected.Pkg(mkpkg(pkg))
+	}
+	assertGraphsEqual(t, reverse.Reachable(mkpkg("c"), 1), expected)
+
+	// And transitively.
+	expected.Pkg(mkpkg("")) // Imports a and b.
+	for _, pkg := range []string{"a/aa", "a/ab"} {
+		expected.Pkg(mkpkg(pkg)).Insert(mkpkg("a"))
+	}
+	expected.Pkg(mkpkg("a/aa/aaa")).Insert(mkpkg("a/aa"))
+	expected.Pkg(mkpkg("b/ba")).Insert(mkpkg("b"))
+	expected.Pkg(mkpkg("a")).Insert(mkpkg(""))
+	expected.Pkg(mkpkg("b")).Insert(mkpkg(""))
+	assertGraphsEqual(t, reverse.Reachable(mkpkg("c"), 0), expected)
+
+	assert.Nil(t, reverse.Reachable(Package("missing"), 0))
+}
+
+func TestShortestPath(t *testing.T) {
+	g := expectedGraph(false, true)
+	// Both a and b lead to c; a sorts first.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, Path{mkpkg(""), mkpkg("a"), mkpkg("c")}, g.ShortestPath(mkpkg(""), mkpkg("c")))
+	}
+	assert.Equal(t, Path{mkpkg("a")}, g.ShortestPath(mkpkg("a"), mkpkg("a")))
+	assert.Nil(t, g.ShortestPath(mkpkg("c"), mkpkg("a")))
+	assert.Nil(t, g.ShortestPath(mkpkg(""), Package("missing")))
+
+	// The longer path sorts first, but is not returned.
+	g = NewGraph()
+	g.AddPath(Path{"s", "a", "b", "t"})
+	g.AddPath(Path{"s", "z", "t"})
+	assert.Equal(t, Path{"s", "z", "t"}, g.ShortestPathCond("s", func(pkg Package) bool {
+		return pkg == "t"
+	}))
+}
+
+func TestMinCut(t *testing.T) {
+	g := expectedGraph(false, true)
+	assert.Equal(t, []Edge{{mkpkg(""), mkpkg("a")}}, g.MinCut(mkpkg(""), mkpkg("a/aa/aaa")))
+	assert.Equal(t, []Edge{{mkpkg(""), mkpkg("a")}, {mkpkg(""), mkpkg("b")}}, g.MinCut(mkpkg(""), mkpkg("c")))
+	assert.Nil(t, g.MinCut(mkpkg("c"), mkpkg("a")))
+	assert.Nil(t, g.MinCut(mkpkg("a"), mkpkg("a")))
+
+	// Both paths go through m.
+	g = NewGraph()
+	g.AddPath(Path{"s", "a", "m", "t"})
+	g.AddPath(Path{"s", "b", "m"})
+	assert.Equal(t, []Edge{{"m", "t"}}, g.MinCut("s", "t"))
+
+	// The first path found goes through a -> b, and the flow on it must be
+	// cancelled to find the second.
+	g = NewGraph()
+	g.AddPath(Path{"s", "a", "b", "t"})
+	g.AddPath(Path{"s", "c", "b"})
+	g.AddPath(Path{"a", "d", "e", "t"})
+	cut := g.MinCut("s", "t")
+	assert.Len(t, cut, 2)
+	for _, edge := range cut {
+		g[edge.From].Delete(edge.To)
+	}
+	assert.Nil(t, g.ShortestPath("s", "t"))
+}
+
+func TestKShortestPaths(t *testing.T) {
+	g := NewGraph()
+	g.AddPath(Path{"s", "a", "t"})
+	g.AddPath(Path{"s", "b", "t"})
+	g.AddPath(Path{"s", "c", "d", "t"})
+	g.AddPath(Path{"a", "d", "a"}) // A cycle.
+
+	expected := []Path{
+		{"s", "a", "t"},
+		{"s", "b", "t"},
+		{"s", "a", "d", "t"},
+		{"s", "c", "d", "t"},
+		{"s", "c", "d", "a", "t"},
+	}
+	assert.Equal(t, expected[:3], g.KShortestPaths("s", "t", 3))
+	assert.Equal(t, expected, g.KShortestPaths("s", "t", 10))
+	assert.Equal(t, expected[:1], g.KShortestPaths("s", "t", 1))
+	assert.Nil(t, g.KShortestPaths("s", "t", 0))
+	assert.Nil(t, g.KShortestPaths("t", "s", 3))
+
+	// Paths stop at the first matching package.
+	paths := g.KShortestPathsCond("s", func(pkg Package) bool {
+		return pkg == "a" || pkg == "t"
+	}, 10)
+	assert.Equal(t, []Path{{"s", "a"}, {"s", "b", "t"}, {"s", "c", "d", "a"}, {"s", "c", "d", "t"}}, paths)
+}
+
+func TestCycles(t *testing.T) {
+	g := expectedGraph(false, false)
+	assert.Len(t, g.StronglyConnectedComponents(), len(g))
+	assert.Nil(t, g.Cycles())
+
+	// a -> a/aa -> a/aa/aaa -> a, and b <-> b/ba.
+	g.Pkg(mkpkg("a/aa/aaa")).Insert(mkpkg("a"))
+	g.Pkg(mkpkg("b/ba")).Insert(mkpkg("b"))
+	components := g.StronglyConnectedComponents()
+	assert.Equal(t, [][]Package{
+		{mkpkg("")},
+		{mkpkg("a"), mkpkg("a/aa"), mkpkg("a/aa/aaa")},
+		{mkpkg("a/ab")},
+		{mkpkg("b"), mkpkg("b/ba")},
+	}, components)
+	assert.Equal(t, []Path{
+		{mkpkg("a"), mkpkg("a/aa"), mkpkg("a/aa/aaa"), mkpkg("a")},
+		{mkpkg("b"), mkpkg("b/ba"), mkpkg("b")},
+	}, g.Cycles())
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := ReadPolicy(strings.NewReader(`{
+		"rules": [
+			{"name": "no tests", "from": "testdata$", "to": "/c$"},
+			{"from": "/a/", "to": "^errors$", "direct": true},
+			{"from": "/b", "to": "/a"}
+		]
+	}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	violations, err := policy.Check(expectedGraph(true, true))
+	assert.NoError(t, err)
+	assert.Equal(t, []Violation{
+		{Rule: policy.Rules[0], Path: Path{mkpkg(""), mkpkg("a"), mkpkg("c")}},
+		{Rule: policy.Rules[1], Path: Path{mkpkg("a/aa"), "errors"}},
+		{Rule: policy.Rules[1], Path: Path{mkpkg("a/aa/aaa"), "errors"}},
+		{Rule: policy.Rules[1], Path: Path{mkpkg("a/ab"), "errors"}},
+	}, violations)
+	assert.Equal(t, "no tests", policy.Rules[0].String())
+	assert.Equal(t, "/a/ must not import ^errors$", policy.Rules[1].String())
+
+	_, err = ReadPolicy(strings.NewReader(`{"rules": [{"from": "(", "to": "a"}]}`))
+	assert.Error(t, err)
+	_, err = ReadPolicy(strings.NewReader(`{"rules": [{"from": "a"}]}`))
+	assert.Error(t, err)
+	_, err = ReadPolicy(strings.NewReader(`{"rules": [{"form": "a", "to": "b"}]}`))
+	assert.Error(t, err)
+}
+
+func TestPolicyLayers(t *testing.T) {
+	policy, err := ReadPolicy(strings.NewReader(`{
+		"layers": [
+			{"name": "leaves", "packages": "/(a/aa/aaa|a/ab|b/ba|c)$"},
+			{"name": "middle", "packages": "/(a|a/aa|b)$"},
+			{"name": "top", "packages": "testdata$"}
+		]
+	}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	g := expectedGraph(false, true)
+	violations, err := policy.Check(g)
+	assert.NoError(t, err)
+	assert.Len(t, violations, 0)
+
+	// c is a leaf, so it must not import b.
+	g.Pkg(mkpkg("c")).Insert(mkpkg("b"))
+	violations, err = policy.Check(g)
+	assert.NoError(t, err)
+	assert.Equal(t, []Violation{{
+		Path:      Path{mkpkg("c"), mkpkg("b")},
+		FromLayer: policy.Layers[0],
+		ToLayer:   policy.Layers[1],
+	}}, violations)
+	assert.Equal(t, "layer leaves must not import layer middle", violations[0].String())
+	assert.Equal(t, -1, policy.LayerOf("errors"))
+
+	_, err = ReadPolicy(strings.NewReader(`{"layers": [{"name": "a", "packages": "a"}, {"name": "a", "packages": "b"}]}`))
+	assert.Error(t, err)
+
+	// The layers are rendered as clusters, with the violation in red.
+	assertGolden(t, "layers.golden", g.DotStyled([]Package{mkpkg("")}, DotStyle{
+		Label: func(pkg Package) string { return string(pkg) },
+		Cluster: func(pkg Package) string {
+			if i := policy.LayerOf(pkg); i >= 0 {
+				return policy.Layers[i].Name
+			}
+			return ""
+		},
+		EdgeAttrs: func(from, to Package) string {
+			if from == mkpkg("c") && to == mkpkg("b") {
+				return `color="red"`
+			}
+			return ""
+		},
+	}))
+}
+
+func TestDiff(t *testing.T) {
+	a := Dependencies{
+		Forward: expectedGraph(false, false),
+		Info:    map[Package]*DependencyInfo{mkpkg("a"): {LOC: 10, TransitiveLOC: 40}},
+	}
+	b := Dependencies{
+		Forward: expectedGraph(false, true),
+		Info:    map[Package]*DependencyInfo{mkpkg("a"): {LOC: 12, TransitiveLOC: 50}},
+	}
+	delete(b.Forward, mkpkg("b/ba"))
+	delete(b.Forward[mkpkg("b")], mkpkg("b/ba"))
+
+	d := Diff(a, b)
+	assert.Equal(t, []Package{mkpkg("c")}, d.AddedPackages)
+	assert.Equal(t, []Package{mkpkg("b/ba")}, d.RemovedPackages)
+	var added []Edge
+	for _, pkg := range []string{"a", "a/aa", "a/aa/aaa", "a/ab", "b"} {
+		added = append(added, Edge{mkpkg(pkg), mkpkg("c")})
+	}
+	assert.Equal(t, added, d.AddedEdges)
+	assert.Equal(t, []Edge{{mkpkg("b"), mkpkg("b/ba")}}, d.RemovedEdges)
+	assert.Equal(t, []LOCChange{{mkpkg("a"), 10, 12, 40, 50}}, d.LOCChanges)
+	assert.False(t, d.Empty())
+	assert.Len(t, d.Graph(), 7)
+
+	assert.True(t, Diff(a, a).Empty())
+}
+
+func TestBaseline(t *testing.T) {
+	d := Dependencies{Roots: []Package{mkpkg("")}, Forward: expectedGraph(false, false)}
+	for _, withEdges := range []bool{false, true} {
+		var buf bytes.Buffer
+		assert.NoError(t, NewBaseline(d, withEdges).Write(&buf))
+		baseline, err := ReadBaseline(&buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, d.Roots, baseline.Roots)
+		assert.False(t, baseline.Check(d).Grown())
+		assert.True(t, baseline.Check(d).Empty())
+
+		// Removals are allowed.
+		shrunk := Dependencies{Forward: expectedGraph(false, false)}
+		delete(shrunk.Forward, mkpkg("b/ba"))
+		delete(shrunk.Forward[mkpkg("b")], mkpkg("b/ba"))
+		diff := baseline.Check(shrunk)
+		assert.False(t, diff.Grown())
+		assert.Equal(t, []Package{mkpkg("b/ba")}, diff.RemovedPackages)
+
+		// New edges only break the baseline if they are recorded.
+		grown := Dependencies{Forward: expectedGraph(false, false)}
+		grown.Forward.Pkg(mkpkg("b")).Insert(mkpkg("a"))
+		assert.Equal(t, withEdges, baseline.Check(grown).Grown())
+
+		grown.Forward.Pkg(mkpkg("b")).Insert(mkpkg("c"))
+		grown.Forward.Pkg(mkpkg("c"))
+		diff = baseline.Check(grown)
+		assert.True(t, diff.Grown())
+		assert.Equal(t, []Package{mkpkg("c")}, diff.AddedPackages)
+	}
+	assertGolden(t, "baseline.golden", func() string {
+		var buf bytes.Buffer
+		NewBaseline(d, true).Write(&buf)
+		return buf.String()
+	}())
+
+	// A baseline of a graph without edges keeps recording edges.
+	var buf bytes.Buffer
+	single := Dependencies{Roots: []Package{"a"}, Forward: NewGraph()}
+	single.Forward.Pkg("a")
+	assert.NoError(t, NewBaseline(single, true).Write(&buf))
+	baseline, err := ReadBaseline(&buf)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, baseline.Edges)
+		single.Forward.Pkg("a").Insert("a")
+		assert.True(t, baseline.Check(single).Grown())
+	}
+
+	// Baselines without a mode record edges if they have any.
+	baseline, err = ReadBaseline(strings.NewReader("package a\npackage b\n"))
+	if assert.NoError(t, err) {
+		assert.Nil(t, baseline.Edges)
+	}
+	baseline, err = ReadBaseline(strings.NewReader("package a\npackage b\nedge a b\n"))
+	if assert.NoError(t, err) {
+		assert.True(t, baseline.Edges["a"].Has("b"))
+	}
+
+	for _, invalid := range []string{
+		"package a b\n",
+		"mode imports\n",
+		"mode edges\nmode packages\n",
+		"mode packages\nedge a b\n",
+	} {
+		_, err = ReadBaseline(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+var update = flag.Bool("update", false, "update golden files")
+
+// assertGolden compares the output with the golden file in testdata/golden.
+func assertGolden(t *testing.T, name, output string) {
+	golden := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(output), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, string(expected), output, name)
+}
+
+func TestGoldenOutput(t *testing.T) {
+	g := expectedGraph(true, true)
+	// Add a cycle through c.
+	g.Pkg(mkpkg("c")).Insert(mkpkg("b/ba"))
+	labelFn := func(pkg Package) string {
+		return string(pkg)
+	}
+
+	// Every run produces the same output.
+	for i := 0; i < 10; i++ {
+		var list bytes.Buffer
+		for _, pkg := range g.List(mkpkg("")) {
+			fmt.Fprintln(&list, pkg)
+		}
+		assertGolden(t, "list.golden", list.String())
+		assertGolden(t, "dot.golden", g.Dot(mkpkg(""), labelFn))
+
+		var paths bytes.Buffer
+		g.DepthFirst(mkpkg(""), func(pkg Package, _ Set, path Path) (bool, bool) {
+			fmt.Fprintln(&paths, path)
+			return true, true
+		})
+		assertGolden(t, "depthfirst.golden", paths.String())
+	}
+}
+
+func TestUnordered(t *testing.T) {
+	g := expectedGraph(true, true)
+	list := g.ListUnordered(mkpkg(""))
+	assert.Len(t, list, len(g))
+	assert.Equal(t, mkpkg(""), list[0])
+	assert.ElementsMatch(t, g.List(mkpkg("")), list)
+
+	// Unordered dot output renders the same packages and edges.
+	lines := func(dot string) []string {
+		return strings.Split(dot, "\n")
+	}
+	label := func(pkg Package) string { return string(pkg) }
+	sorted := g.DotStyled([]Package{mkpkg("")}, DotStyle{Label: label})
+	unordered := g.DotStyled([]Package{mkpkg("")}, DotStyle{Label: label, Unordered: true})
+	assert.Len(t, lines(unordered), len(lines(sorted)))
+}
+
+func TestListRoots(t *testing.T) {
+	g := expectedGraph(false, false)
+	list := g.List(mkpkg("a/aa"), mkpkg("b"))
+	if assert.Len(t, list, 4) {
+		// Roots are at depth 0, so they are listed first.
+		assert.ElementsMatch(t, []Package{mkpkg("a/aa"), mkpkg("b")}, list[:2])
+		assert.ElementsMatch(t, []Package{mkpkg("a/aa/aaa"), mkpkg("b/ba")}, list[2:])
+	}
+}
+
 func assertGraphsEqual(t *testing.T, actual, expected Graph) {
 	// Check for missing packages.
 	for pkg, imports := range expected {
@@ -169,6 +582,883 @@ func assertSetsEqual(t *testing.T, actual, expected Set, ctx string) {
 	}
 }
 
+func TestBuildModules(t *testing.T) {
+	modules, err := LoadModules("testdata/modules/main/cmd/server", "testdata/modules/modcache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "example.com/main", modules.Main.Path)
+	// The main module's requirement on v1.1.0 is excluded, so lib's v1.0.0 is
+	// selected, even though later versions are in the module cache.
+	assert.Equal(t, "v1.0.0", modules.List["example.com/util"].Version)
+	// lib is replaced with a local directory.
+	libDir, _ := filepath.Abs("testdata/modules/lib")
+	assert.Equal(t, libDir, modules.List["example.com/lib"].Dir)
+
+	serverDir, _ := filepath.Abs("testdata/modules/main/cmd/server")
+	root, err := modules.Resolve(".", serverDir, build.Default)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "example.com/main/cmd/server", root)
+
+	deps, err := (&Builder{
+		Roots:   []Package{root},
+		BaseDir: serverDir,
+		Loader:  &ModuleLoader{Modules: modules, Context: build.Default},
+	}).Build()
+	assert.NoError(t, err)
+
+	expected := NewGraph()
+	expected.Pkg("example.com/main/cmd/server").Insert("example.com/main")
+	expected.Pkg("example.com/main/cmd/server").Insert("example.com/util/strs")
+	expected.Pkg("example.com/main").Insert("example.com/lib")
+	expected.Pkg("example.com/lib").Insert("example.com/util/strs")
+	expected.Pkg("example.com/util/strs")
+	assertGraphsEqual(t, deps.Forward, expected)
+	assertSetsEqual(t, deps.Ignored, NewSet(Package("errors")), "Ignored")
+
+	// Local patterns match packages in the main module, and not in the
+	// replaced module outside of it.
+	mainDir, _ := filepath.Abs("testdata/modules/main")
+	deps, err = (&Builder{
+		Roots:   []Package{"./..."},
+		BaseDir: mainDir,
+		Loader:  &ModuleLoader{Modules: modules, Context: build.Default},
+	}).Build()
+	assert.NoError(t, err)
+	assert.Equal(t, []Package{"example.com/main", "example.com/main/cmd/server"}, deps.Roots)
+	assertGraphsEqual(t, deps.Forward, expected)
+}
+
+func TestBuildModulesStdVendor(t *testing.T) {
+	const vendored = "vendor/golang.org/x/net/http/httpguts"
+	if !isDir(filepath.Join(build.Default.GOROOT, "src", vendored)) {
+		t.Skip("net/http does not vendor golang.org/x/net/http/httpguts")
+	}
+	modules, err := LoadModules("testdata/modules/web", "testdata/modules/modcache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	webDir, _ := filepath.Abs("testdata/modules/web")
+
+	for _, cache := range []bool{false, true} {
+		b := &Builder{
+			Roots:         []Package{"example.com/web"},
+			BaseDir:       webDir,
+			IncludeStdlib: true,
+			Loader:        &ModuleLoader{Modules: modules, Context: build.Default},
+		}
+		if cache {
+			dir, err := ioutil.TempDir("", "godepq-cache")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer os.RemoveAll(dir)
+			b.Cache = &Cache{Dir: dir}
+		}
+		deps, err := b.Build()
+		if !assert.NoError(t, err) {
+			return
+		}
+		// The main module imports x/net from the build list, while net/http
+		// imports the copy vendored into the standard library.
+		assert.True(t, deps.Forward["example.com/web"].Has("golang.org/x/net/http/httpguts"))
+		assert.False(t, deps.Info["golang.org/x/net/http/httpguts"].Stdlib)
+		assert.True(t, deps.Forward["net/http"].Has(vendored))
+		assert.False(t, deps.Forward["net/http"].Has("golang.org/x/net/http/httpguts"))
+		assert.True(t, deps.Info[vendored].Stdlib)
+	}
+}
+
+func TestBuildGoLoaders(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := filepath.Abs("../testdata")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, includeTests := range []bool{false, true} {
+		loaders := map[string]Loader{
+			"packages": &PackagesLoader{Tests: includeTests},
+			"golist":   &GoListLoader{},
+		}
+		for name, loader := range loaders {
+			deps, err := (&Builder{
+				Roots:        []Package{Package(basePkg)},
+				BaseDir:      dir,
+				Loader:       loader,
+				IncludeTests: includeTests,
+			}).Build()
+			if !assert.NoError(t, err, name) {
+				continue
+			}
+			assertGraphsEqual(t, deps.Forward, expectedGraph(false, includeTests))
+			assert.True(t, deps.Ignored.Has("errors"), name)
+			if !includeTests {
+				continue
+			}
+
+			// The test variants are folded into the package under test.
+			b, err := loader.Load(string(mkpkg("b")), dir)
+			if !assert.NoError(t, err, name) {
+				continue
+			}
+			// go/packages lists cgo files with the other files.
+			assert.Equal(t, []string{"imports.go"}, append(b.GoFiles, b.CgoFiles...), name)
+			assert.Equal(t, []string{"imports_test.go"}, b.TestGoFiles, name)
+			assert.Equal(t, []string{"external_test.go"}, b.XTestGoFiles, name)
+			assert.Equal(t, []string{string(mkpkg("c"))}, b.TestImports, name)
+			assert.ElementsMatch(t, []string{string(mkpkg("b")), string(mkpkg("c"))}, b.XTestImports, name)
+		}
+	}
+}
+
+func TestTestVariantOf(t *testing.T) {
+	for _, test := range []struct {
+		id, path, forTest string
+		isTest            bool
+	}{
+		{"example.com/p", "example.com/p", "", false},
+		{"example.com/p [example.com/p.test]", "example.com/p", "example.com/p", true},
+		{"example.com/p_test [example.com/p.test]", "example.com/p_test", "example.com/p", true},
+		// A dependency recompiled for the test.
+		{"example.com/q [example.com/p.test]", "example.com/q", "example.com/p", true},
+		// The generated test main.
+		{"example.com/p.test", "example.com/p.test", "", true},
+	} {
+		forTest, isTest := testVariantOf(&packages.Package{ID: test.id, PkgPath: test.path})
+		assert.Equal(t, test.forTest, forTest, test.id)
+		assert.Equal(t, test.isTest, isTest, test.id)
+	}
+}
+
+func TestBuildStaticLoader(t *testing.T) {
+	f, err := os.Open("testdata/packages.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	loader, err := ReadPackages(f)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, includeTests := range []bool{false, true} {
+		deps, err := (&Builder{
+			Roots:         []Package{Package(basePkg)},
+			Loader:        loader,
+			IncludeStdlib: true,
+			IncludeTests:  includeTests,
+		}).Build()
+		assert.NoError(t, err)
+		assertGraphsEqual(t, deps.Forward, expectedGraph(true, includeTests))
+		assert.Len(t, deps.Ignored, 0)
+
+		expectedLOC := 10
+		if includeTests {
+			expectedLOC += 5
+		}
+		assert.Equal(t, expectedLOC, deps.Info[mkpkg("a")].LOC)
+		assert.Equal(t, 100, deps.Info["errors"].LOC)
+		if !includeTests {
+			// errors is counted once, and is not exclusive to a.
+			assert.Equal(t, 140, deps.Info[mkpkg("a")].TransitiveLOC)
+			assert.Equal(t, 40, deps.Info[mkpkg("a")].ExclusiveLOC)
+			assert.Equal(t, 170, deps.Info[mkpkg("")].ExclusiveLOC)
+		}
+	}
+
+	root, err := loader.Load(".", "/fixture/testdata/a")
+	assert.NoError(t, err)
+	assert.Equal(t, string(mkpkg("a")), root.ImportPath)
+
+	matches, err := loader.Expand("./a/...", "/fixture/testdata")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{string(mkpkg("a")), string(mkpkg("a/aa")), string(mkpkg("a/aa/aaa")), string(mkpkg("a/ab"))}, matches)
+}
+
+func TestBuildConcurrent(t *testing.T) {
+	for _, includeTests := range []bool{false, true} {
+		newBuilder := func(jobs int) *Builder {
+			return &Builder{
+				Roots:        []Package{"go/build", Package(basePkg)},
+				BuildContext: build.Default,
+				// The tests of the standard library need vendored packages.
+				IncludeStdlib: !includeTests,
+				IncludeTests:  includeTests,
+				Jobs:          jobs,
+			}
+		}
+		serial, err := newBuilder(1).Build()
+		if !assert.NoError(t, err) {
+			return
+		}
+		concurrent, err := newBuilder(8).Build()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, serial, concurrent)
+	}
+
+	// The error is the one the serial walk finds first.
+	loader := StaticLoader{
+		"root": {ImportPath: "root", Imports: []string{"a", "b"}},
+		"a":    {ImportPath: "a", Imports: []string{"missing-a"}},
+		"b":    {ImportPath: "b", Imports: []string{"missing-b"}},
+	}
+	for _, jobs := range []int{1, 8} {
+		_, err := (&Builder{Roots: []Package{"root"}, Loader: loader, Jobs: jobs}).Build()
+		if assert.Error(t, err) {
+			assert.Equal(t, `cannot find package "missing-a"`, err.Error())
+		}
+	}
+}
+
+// slowLoader delays each load, like reading packages from a cold disk or a
+// network file system.
+type slowLoader struct {
+	Loader
+	delay time.Duration
+}
+
+func (l slowLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	time.Sleep(l.delay)
+	return l.Loader.Load(importPath, srcDir)
+}
+
+func BenchmarkBuild(b *testing.B) {
+	loaders := []struct {
+		name   string
+		loader Loader
+	}{
+		{"stdlib", &BuildLoader{Context: build.Default}},
+		{"slow", slowLoader{&BuildLoader{Context: build.Default}, time.Millisecond}},
+	}
+	roots := []Package{"go/build", "go/types", "encoding/json", "text/template", "os/exec"}
+	for _, l := range loaders {
+		for _, jobs := range []int{1, 8} {
+			b.Run(fmt.Sprintf("%s/j%d", l.name, jobs), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, err := (&Builder{
+						Roots:         roots,
+						Loader:        l.loader,
+						IncludeStdlib: true,
+						Jobs:          jobs,
+					}).Build()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBuildCache compares builds without a cache, with an empty cache,
+// and with a cache holding every package. Cache hits still hash the files of
+// each package, but do not parse them.
+func BenchmarkBuildCache(b *testing.B) {
+	roots := []Package{"go/build", "go/types", "encoding/json", "text/template", "os/exec"}
+	dir, err := ioutil.TempDir("", "godepq-cache")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buildDeps := func(b *testing.B, cache *Cache) {
+		_, err := (&Builder{
+			Roots:         roots,
+			Loader:        &BuildLoader{Context: build.Default},
+			IncludeStdlib: true,
+			Cache:         cache,
+		}).Build()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("none", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildDeps(b, nil)
+		}
+	})
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			cache := &Cache{Dir: filepath.Join(dir, fmt.Sprintf("cold%d", i))}
+			b.StartTimer()
+			buildDeps(b, cache)
+		}
+	})
+	b.Run("warm", func(b *testing.B) {
+		cache := &Cache{Dir: filepath.Join(dir, "warm")}
+		buildDeps(b, cache)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			buildDeps(b, cache)
+		}
+	})
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godepq-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cache := &Cache{Dir: filepath.Join(dir, "cache")}
+	pkgDir := filepath.Join(dir, "p")
+	write := func(src string, mtime time.Time) {
+		file := filepath.Join(pkgDir, "p.go")
+		assert.NoError(t, ioutil.WriteFile(file, []byte(src), 0644))
+		assert.NoError(t, os.Chtimes(file, mtime, mtime))
+	}
+	assert.NoError(t, os.MkdirAll(pkgDir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(pkgDir, "go.mod"), []byte("module example.com/p\n"), 0644))
+	write("package p\n\nimport _ \"errors\"\n", time.Unix(1, 0))
+	modules, err := LoadModules(pkgDir, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	loader := &countingLoader{ModuleLoader: ModuleLoader{Modules: modules, Context: build.Default}}
+	buildDeps := func(cache *Cache) Dependencies {
+		*loader = countingLoader{ModuleLoader: loader.ModuleLoader}
+		deps, err := (&Builder{
+			Roots:         []Package{"example.com/p", "go/build"},
+			Loader:        loader,
+			IncludeStdlib: true,
+			Cache:         cache,
+		}).Build()
+		assert.NoError(t, err)
+		return deps
+	}
+	uncached := buildDeps(nil)
+	assert.Equal(t, uncached, buildDeps(cache))
+	// Packages which are not cached are loaded from the directories found
+	// for their keys.
+	assert.Equal(t, len(uncached.Forward), loader.finds)
+	assert.Equal(t, len(uncached.Forward), loader.loadFounds)
+	assert.Equal(t, 0, loader.loads)
+	entries, err := filepath.Glob(filepath.Join(cache.Dir, "*", "*.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, len(uncached.Forward), len(entries))
+	// The second build reads the cached entries, without loading any package.
+	assert.Equal(t, uncached, buildDeps(cache))
+	assert.Equal(t, len(uncached.Forward), loader.finds)
+	assert.Equal(t, 0, loader.loadFounds)
+	assert.Equal(t, 0, loader.loads)
+
+	// Changed packages are read again, even if their size and modification
+	// time are the same.
+	write("package p\n\nimport _ \"unsafe\"\n", time.Unix(1, 0))
+	deps := buildDeps(cache)
+	assert.Equal(t, 1, loader.loadFounds)
+	assert.True(t, deps.Forward["example.com/p"].Has("unsafe"))
+	assert.False(t, deps.Forward["example.com/p"].Has("errors"))
+	assert.Equal(t, buildDeps(nil), deps)
+}
+
+// countingLoader counts the packages a ModuleLoader finds and loads.
+type countingLoader struct {
+	ModuleLoader
+	finds, loadFounds, loads int
+}
+
+func (l *countingLoader) Find(importPath, srcDir string) (*build.Package, error) {
+	l.finds++
+	return l.ModuleLoader.Find(importPath, srcDir)
+}
+
+func (l *countingLoader) LoadFound(found *build.Package) (*LoadedPackage, error) {
+	l.loadFounds++
+	return l.ModuleLoader.LoadFound(found)
+}
+
+func (l *countingLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	l.loads++
+	return l.ModuleLoader.Load(importPath, srcDir)
+}
+
+func TestRecursiveLOC(t *testing.T) {
+	// z and w import each other, and are only reachable through x and y.
+	imports := map[string][]string{
+		"root": {"x", "y"},
+		"x":    {"z", "v"},
+		"y":    {"z"},
+		"z":    {"w"},
+		"w":    {"z"},
+		"v":    nil,
+	}
+	loc := map[string]int{"root": 1, "x": 2, "y": 4, "z": 8, "w": 16, "v": 32}
+	loader := make(StaticLoader)
+	for pkg, imps := range imports {
+		loader[pkg] = &LoadedPackage{
+			ImportPath: pkg,
+			Imports:    imps,
+			GoFiles:    []string{pkg + ".go"},
+			FileLOC:    map[string]int{pkg + ".go": loc[pkg]},
+		}
+	}
+	deps, err := (&Builder{Roots: []Package{"root"}, Loader: loader}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	expected := map[Package]DependencyInfo{
+		"root": {LOC: 1, TransitiveLOC: 63, ExclusiveLOC: 63},
+		"x":    {LOC: 2, TransitiveLOC: 58, ExclusiveLOC: 34},
+		"y":    {LOC: 4, TransitiveLOC: 28, ExclusiveLOC: 4},
+		"z":    {LOC: 8, TransitiveLOC: 24, ExclusiveLOC: 24},
+		"w":    {LOC: 16, TransitiveLOC: 24, ExclusiveLOC: 16},
+		"v":    {LOC: 32, TransitiveLOC: 32, ExclusiveLOC: 32},
+	}
+	for pkg, info := range expected {
+		assert.Equal(t, info, *deps.Info[pkg], string(pkg))
+	}
+
+	// Removing an import drops the code only reachable through it. z is also
+	// imported by y, so removing x's import of z drops nothing.
+	edgeLOC := map[Edge]int{
+		{"root", "x"}: 34,
+		{"root", "y"}: 4,
+		{"x", "z"}:    0,
+		{"x", "v"}:    32,
+		{"y", "z"}:    0,
+		{"z", "w"}:    16,
+		{"w", "z"}:    0,
+	}
+	for e, loc := range edgeLOC {
+		exclusive := 0
+		if info, ok := deps.EdgeInfo[e]; ok {
+			exclusive = info.ExclusiveLOC
+		}
+		assert.Equal(t, loc, exclusive, fmt.Sprintf("%s -> %s", e.From, e.To))
+	}
+}
+
+func TestEdgeInfo(t *testing.T) {
+	deps, err := (&Builder{
+		Roots:        []Package{Package(basePkg)},
+		BuildContext: build.Default,
+		IncludeTests: true,
+	}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"imports.go", 13}}, ExclusiveLOC: deps.Info[mkpkg("b")].ExclusiveLOC}, deps.EdgeInfo[Edge{mkpkg(""), mkpkg("b")}])
+	assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"imports.go", 14}}, ExclusiveLOC: deps.Info[mkpkg("a/aa")].ExclusiveLOC}, deps.EdgeInfo[Edge{mkpkg("a"), mkpkg("a/aa")}])
+	assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"imports_test.go", 12}}, Kind: TestEdge}, deps.EdgeInfo[Edge{mkpkg("a"), mkpkg("c")}])
+	assert.Len(t, deps.EdgeInfo, 12)
+
+	data, err := json.Marshal(deps)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(data), `"positions":["imports.go:14"]`)
+	var decoded Dependencies
+	if assert.NoError(t, json.Unmarshal(data, &decoded)) {
+		assert.Equal(t, deps.EdgeInfo, decoded.EdgeInfo)
+	}
+
+	// Positions are parsed from the sources if the loader does not record them.
+	pkg, err := (&BuildLoader{Context: build.Default}).Load(string(mkpkg("a")), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	pkg.ImportPos, pkg.TestImportPos, pkg.XTestImportPos = nil, nil, nil
+	deps, err = (&Builder{
+		Roots: []Package{mkpkg("a")},
+		Loader: StaticLoader{
+			string(mkpkg("a")):    pkg,
+			string(mkpkg("a/aa")): {ImportPath: string(mkpkg("a/aa"))},
+			string(mkpkg("a/ab")): {ImportPath: string(mkpkg("a/ab"))},
+			"errors":              {ImportPath: "errors", Standard: true},
+		},
+	}).Build()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"imports.go", 14}}}, deps.EdgeInfo[Edge{mkpkg("a"), mkpkg("a/aa")}])
+	}
+
+	// Nothing is read from the sources of packages recorded without them.
+	pkg.NoSources = true
+	pkg.FileLOC = map[string]int{"imports.go": 7}
+	deps, err = (&Builder{
+		Roots: []Package{mkpkg("a")},
+		Loader: StaticLoader{
+			string(mkpkg("a")):    pkg,
+			string(mkpkg("a/aa")): {ImportPath: string(mkpkg("a/aa"))},
+			string(mkpkg("a/ab")): {ImportPath: string(mkpkg("a/ab"))},
+			"errors":              {ImportPath: "errors", Standard: true},
+		},
+	}).Build()
+	if assert.NoError(t, err) {
+		assert.Nil(t, deps.EdgeInfo[Edge{mkpkg("a"), mkpkg("a/aa")}])
+		assert.Equal(t, 7, deps.Info[mkpkg("a")].LOC)
+	}
+}
+
+func TestVendoredEdgeInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godepq-vendor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	src := "package p\n\nimport (\n\t\"example.com/q\"\n\t\"golang.org/x/net/dns\"\n)\n"
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0666)) {
+		return
+	}
+	src = "//go:build linux\n\npackage p\n\nimport \"example.com/r\"\n"
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "p_r.go"), []byte(src), 0666)) {
+		return
+	}
+
+	// Loaders like go list report the vendored paths the imports resolve to.
+	deps, err := (&Builder{
+		Roots: []Package{"p"},
+		Loader: StaticLoader{
+			"p": {
+				ImportPath: "p",
+				Dir:        dir,
+				Imports:    []string{"p/vendor/example.com/q", "p/vendor/example.com/r", "vendor/golang.org/x/net/dns"},
+				GoFiles:    []string{"p.go", "p_r.go"},
+			},
+			"p/vendor/example.com/q":      {ImportPath: "p/vendor/example.com/q"},
+			"p/vendor/example.com/r":      {ImportPath: "p/vendor/example.com/r"},
+			"vendor/golang.org/x/net/dns": {ImportPath: "vendor/golang.org/x/net/dns"},
+		},
+	}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"p.go", 4}}}, deps.EdgeInfo[Edge{"p", "example.com/q"}])
+	assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"p_r.go", 5}}, Constraint: "linux"}, deps.EdgeInfo[Edge{"p", "example.com/r"}])
+	assert.Equal(t, &EdgeInfo{Positions: []ImportPos{{"p.go", 5}}}, deps.EdgeInfo[Edge{"p", "vendor/golang.org/x/net/dns"}])
+}
+
+func TestEdgeKinds(t *testing.T) {
+	loader := StaticLoader{
+		"root": {ImportPath: "root", Imports: []string{"p"}, TestImports: []string{"p", "t"}, XTestImports: []string{"t", "x", "root"}},
+		"p":    {ImportPath: "p", Imports: []string{"q"}, TestImports: []string{"pt"}},
+		"q":    {ImportPath: "q", TestImports: []string{"root"}},
+		"t":    {ImportPath: "t"},
+		"x":    {ImportPath: "x"},
+		"pt":   {ImportPath: "pt"},
+	}
+	deps, err := (&Builder{Roots: []Package{"root"}, Loader: loader, IncludeTests: true}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	kind := func(from, to Package) EdgeKind {
+		if info, ok := deps.EdgeInfo[Edge{from, to}]; ok {
+			return info.Kind
+		}
+		return ProdEdge
+	}
+	assert.Equal(t, ProdEdge, kind("root", "p"))
+	assert.Equal(t, TestEdge, kind("root", "t"))
+	assert.Equal(t, XTestEdge, kind("root", "x"))
+	assert.Equal(t, TestEdge, kind("p", "pt"))
+	assert.True(t, deps.Forward["q"].Has("root"))
+
+	data, err := json.Marshal(deps)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(data), `{"from":"root","to":"x","kind":"xtest"}`)
+	var decoded Dependencies
+	if assert.NoError(t, json.Unmarshal(data, &decoded)) {
+		assert.Equal(t, deps.EdgeInfo, decoded.EdgeInfo)
+	}
+
+	// Only the tests of the roots are followed.
+	deps, err = (&Builder{Roots: []Package{"root"}, Loader: loader, IncludeTests: true, RootTestsOnly: true}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := NewGraph()
+	for _, imp := range []Package{"p", "t", "x"} {
+		expected.Pkg("root").Insert(imp)
+	}
+	expected.Pkg("p").Insert("q")
+	expected.Pkg("q")
+	expected.Pkg("t")
+	expected.Pkg("x")
+	assertGraphsEqual(t, deps.Forward, expected)
+
+	// Including roots which are imported by other roots.
+	deps, err = (&Builder{Roots: []Package{"root", "p"}, Loader: loader, IncludeTests: true, RootTestsOnly: true}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected.Pkg("p").Insert("pt")
+	expected.Pkg("pt")
+	assertGraphsEqual(t, deps.Forward, expected)
+	assert.True(t, deps.Info["pt"].TestOnly)
+	assert.False(t, deps.Info["q"].TestOnly)
+}
+
+func TestSymbolLoader(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := filepath.Abs("testdata/symbols")
+	if !assert.NoError(t, err) {
+		return
+	}
+	edges := []Edge{
+		{"example.com/symbols/app", "example.com/symbols/lib"},
+		{"example.com/symbols/app", "example.com/symbols/testlib"},
+		{"example.com/symbols/app", "example.com/symbols/side"},
+	}
+	loader := &SymbolLoader{Config: packages.Config{Dir: dir}, Tests: true}
+	symbols, err := loader.Load(edges)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []SymbolUse{
+		{Symbol: "Client", Uses: []ImportPos{{"app.go", 9}}},
+		{Symbol: "Client.Do", Uses: []ImportPos{{"app.go", 10}}},
+		{Symbol: "New", Uses: []ImportPos{{"app.go", 9}}},
+	}, symbols[edges[0]])
+	// Only the tests use testlib.
+	assert.Equal(t, []SymbolUse{{Symbol: "Helper", Uses: []ImportPos{{"app_test.go", 10}}}}, symbols[edges[1]])
+	// Blank imports use no symbols.
+	assert.Equal(t, []SymbolUse{}, symbols[edges[2]])
+
+	loader.Tests = false
+	symbols, err = loader.Load(edges[1:2])
+	if assert.NoError(t, err) {
+		assert.Empty(t, symbols[edges[1]])
+	}
+
+	// The uses in packages with type errors are still found, and the errors
+	// are reported.
+	stderr, err := ioutil.TempFile("", "godepq-stderr")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	oldStderr := os.Stderr
+	os.Stderr = stderr
+	broken := Edge{"example.com/symbols/broken", "example.com/symbols/lib"}
+	symbols, err = loader.Load([]Edge{broken})
+	os.Stderr = oldStderr
+	if assert.NoError(t, err) {
+		assert.Equal(t, []SymbolUse{{Symbol: "New", Uses: []ImportPos{{"broken.go", 8}}}}, symbols[broken])
+	}
+	output, err := ioutil.ReadFile(stderr.Name())
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(output), `Warning: symbols used by "example.com/symbols/broken" may be missing: `)
+		assert.Contains(t, string(output), "broken.go:5")
+	}
+
+	_, err = loader.Load([]Edge{{"example.com/symbols/missing", "example.com/symbols/lib"}})
+	assert.Error(t, err)
+}
+
+func TestPlatform(t *testing.T) {
+	p, err := ParsePlatform("windows/arm64,netgo,osusergo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, Platform{"windows", "arm64", []string{"netgo", "osusergo"}}, p)
+	assert.Equal(t, "windows/arm64,netgo,osusergo", p.String())
+	for _, s := range []string{"", "linux", "linux/", "/amd64", "linux/amd64,", "linux/amd64/arm"} {
+		_, err := ParsePlatform(s)
+		assert.Error(t, err, s)
+	}
+
+	host := build.Context{GOOS: "linux", GOARCH: "amd64", CgoEnabled: true, BuildTags: []string{"a"}}
+	ctx := p.Context(host)
+	assert.Equal(t, "windows", ctx.GOOS)
+	assert.Equal(t, "arm64", ctx.GOARCH)
+	assert.False(t, ctx.CgoEnabled)
+	assert.Equal(t, []string{"a", "netgo", "osusergo"}, ctx.BuildTags)
+	assert.Equal(t, []string{"a"}, host.BuildTags)
+
+	ctx = Platform{Tags: []string{"b"}}.Context(host)
+	assert.Equal(t, "linux", ctx.GOOS)
+	assert.True(t, ctx.CgoEnabled)
+	assert.Equal(t, []string{"X=1", "GOOS=windows", "GOARCH=arm64"}, p.Env([]string{"X=1"}))
+}
+
+func TestMatrix(t *testing.T) {
+	linux := Dependencies{Forward: NewGraph()}
+	linux.Forward.AddPath(Path{"cmd", "net", "unix"})
+	windows := Dependencies{Forward: NewGraph()}
+	windows.Forward.AddPath(Path{"cmd", "net", "windows"})
+	windows.Forward.AddPath(Path{"cmd", "unix"})
+
+	m := NewMatrix([]string{"linux/amd64", "windows/amd64"}, []Dependencies{linux, windows})
+	pkgs, edges := m.Specific()
+	assert.Equal(t, []Package{"windows"}, pkgs)
+	assert.Equal(t, []Edge{{"cmd", "unix"}, {"net", "unix"}, {"net", "windows"}}, edges)
+	assert.Equal(t, []string{"linux/amd64"}, m.In(m.Edges[Edge{"net", "unix"}]))
+	assert.Equal(t, []string{"linux/amd64", "windows/amd64"}, m.In(m.Packages["unix"]))
+	assert.Len(t, m.Graph(), 4)
+}
+
+func TestImportConstraints(t *testing.T) {
+	dir, err := filepath.Abs("testdata/constraints")
+	if !assert.NoError(t, err) {
+		return
+	}
+	loader := StaticLoader{
+		"example.com/p": {
+			ImportPath:     "example.com/p",
+			Dir:            dir,
+			Imports:        []string{"example.com/q", "example.com/r", "example.com/s", "example.com/t", "example.com/u", "example.com/w"},
+			GoFiles:        []string{"doc.go", "legacy.go", "p.go", "p_linux.go", "p_unix.go", "tagged.go"},
+			CgoFiles:       []string{"cgo.go"},
+			TestGoFiles:    []string{"p_test.go"},
+			IgnoredGoFiles: []string{"gen.go", "p_wasip1.go", "p_windows_arm64.go"},
+		},
+	}
+	for _, pkg := range []string{"q", "r", "s", "t", "u", "w"} {
+		loader["example.com/"+pkg] = &LoadedPackage{ImportPath: "example.com/" + pkg}
+	}
+	expected := map[Package]string{
+		"example.com/q": "",
+		// The import in gen.go, which is only built with the ignore tag, is
+		// skipped.
+		"example.com/r": "linux || wasip1 || (windows && arm64)",
+		"example.com/s": "cgo || (foo && !cgo)",
+		"example.com/t": "(bar || baz) && !qux",
+		// Constraints directly above the package clause are its doc comment.
+		"example.com/u": "",
+		// unix is not a file name suffix.
+		"example.com/w": "",
+	}
+	for _, includeTests := range []bool{false, true} {
+		deps, err := (&Builder{Roots: []Package{"example.com/p"}, Loader: loader, IncludeTests: includeTests}).Build()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if includeTests {
+			expected["example.com/t"] = "((bar || baz) && !qux) || linux"
+		}
+		for imp, constraint := range expected {
+			info := deps.EdgeInfo[Edge{"example.com/p", imp}]
+			if assert.NotNil(t, info, string(imp)) {
+				assert.Equal(t, constraint, info.Constraint, string(imp))
+			}
+		}
+	}
+}
+
+func TestDependenciesJSON(t *testing.T) {
+	f, err := os.Open("testdata/packages.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	loader, err := ReadPackages(f)
+	if !assert.NoError(t, err) {
+		return
+	}
+	deps, err := (&Builder{
+		Roots:         []Package{Package(basePkg)},
+		Loader:        loader,
+		IncludeStdlib: true,
+		IncludeTests:  true,
+		Ignored:       []*regexp.Regexp{regexp.MustCompile("/b$")},
+	}).Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, deps.Info["errors"].Stdlib)
+	assert.False(t, deps.Info["errors"].TestOnly)
+	assert.True(t, deps.Info[mkpkg("c")].TestOnly)
+	assert.False(t, deps.Info[mkpkg("a")].TestOnly)
+
+	data, err := json.Marshal(deps)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var decoded Dependencies
+	if !assert.NoError(t, json.Unmarshal(data, &decoded)) {
+		return
+	}
+	assert.Equal(t, deps.Roots, decoded.Roots)
+	assertGraphsEqual(t, decoded.Forward, deps.Forward)
+	assertGraphsEqual(t, decoded.Reverse, deps.Reverse)
+	assertSetsEqual(t, decoded.Ignored, NewSet(mkpkg("b")), "Ignored")
+	assert.Equal(t, deps.Info, decoded.Info)
+
+	// The encoding is stable.
+	again, err := json.Marshal(decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), string(again))
+}
+
+func TestDominators(t *testing.T) {
+	g := expectedGraph(false, true)
+	// Every package reaches c, so only the root dominates it.
+	assert.Equal(t, map[Package]Package{
+		mkpkg(""):         NullPackage,
+		mkpkg("a"):        mkpkg(""),
+		mkpkg("a/aa"):     mkpkg("a"),
+		mkpkg("a/aa/aaa"): mkpkg("a/aa"),
+		mkpkg("a/ab"):     mkpkg("a"),
+		mkpkg("b"):        mkpkg(""),
+		mkpkg("b/ba"):     mkpkg("b"),
+		mkpkg("c"):        mkpkg(""),
+	}, g.Dominators(mkpkg("")))
+
+	// a and b do not share a dominator.
+	idom := g.Dominators(mkpkg("a"), mkpkg("b"))
+	assert.Equal(t, NullPackage, idom[mkpkg("c")])
+	assert.Equal(t, mkpkg("a/aa"), idom[mkpkg("a/aa/aaa")])
+	assert.NotContains(t, idom, mkpkg(""))
+
+	tree := g.DominatorTree(mkpkg(""))
+	assert.Equal(t, []Package{mkpkg("a"), mkpkg("b"), mkpkg("c")}, tree[mkpkg("")].Sorted())
+	assert.Len(t, tree[mkpkg("c")], 0)
+	assert.Len(t, tree, len(g))
+}
+
+func TestBuildPattern(t *testing.T) {
+	modules, err := LoadModules("..", DefaultModCache())
+	if !assert.NoError(t, err) {
+		return
+	}
+	deps, err := (&Builder{
+		Roots:  []Package{Package(basePkg + "/a/..."), mkpkg("a/ab")},
+		Loader: &ModuleLoader{Modules: modules, Context: build.Default},
+	}).Build()
+	assert.NoError(t, err)
+
+	expected := expectedGraph(false, false)
+	for _, pkg := range []string{"", "b", "b/ba"} {
+		delete(expected, mkpkg(pkg))
+	}
+	assertGraphsEqual(t, deps.Forward, expected)
+	// Roots are listed once, in the order they were matched.
+	assert.Equal(t, []Package{mkpkg("a"), mkpkg("a/aa"), mkpkg("a/aa/aaa"), mkpkg("a/ab")}, deps.Roots)
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"...", "github.com/google/godepq", true},
+		{"github.com/google/...", "github.com/google/godepq/deps", true},
+		{"github.com/google/godepq/...", "github.com/google/godepq", true},
+		{"github.com/google/godepq/...", "github.com/google/godepqx", false},
+		{"github.com/google/godepq...", "github.com/google/godepqx", true},
+		{"github.com/.../deps", "github.com/google/godepq/deps", true},
+		{"github.com/google/...", "github.com/google/godepq/vendor/golang.org/x/mod", false},
+		{"github.com/google/godepq/vendor/...", "github.com/google/godepq/vendor/golang.org/x/mod", true},
+		{"./...", "./a/aa", true},
+		{"./a/...", "./b", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, matchPattern(test.pattern)(test.path), "matchPattern(%s)(%s)", test.pattern, test.path)
+	}
+}
+
 func TestStripVendor(t *testing.T) {
 	tests := []struct{ path, expected string }{
 		{"github.com/google/godepq/vendor/github.com/google/cadvisor/manager", "github.com/google/cadvisor/manager"},
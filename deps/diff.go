@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+// GraphDiff is the difference between two dependency graphs. All lists are
+// sorted.
+type GraphDiff struct {
+	AddedPackages   []Package `json:"addedPackages"`
+	RemovedPackages []Package `json:"removedPackages"`
+	AddedEdges      []Edge    `json:"addedEdges"`
+	RemovedEdges    []Edge    `json:"removedEdges"`
+	// The packages in both graphs whose lines of code changed.
+	LOCChanges []LOCChange `json:"locChanges"`
+}
+
+// LOCChange is a change in the lines of code of a package.
+type LOCChange struct {
+	Package          Package `json:"package"`
+	OldLOC           int     `json:"oldLoc"`
+	NewLOC           int     `json:"newLoc"`
+	OldTransitiveLOC int     `json:"oldTransitiveLoc"`
+	NewTransitiveLOC int     `json:"newTransitiveLoc"`
+}
+
+// Diff compares the dependency graphs from two builds, a before a change and b
+// after it.
+func Diff(a, b Dependencies) *GraphDiff {
+	d := &GraphDiff{
+		AddedPackages:   []Package{},
+		RemovedPackages: []Package{},
+		AddedEdges:      []Edge{},
+		RemovedEdges:    []Edge{},
+		LOCChanges:      []LOCChange{},
+	}
+	for _, pkg := range b.Forward.sortedPackages() {
+		if !a.Forward.Has(pkg) {
+			d.AddedPackages = append(d.AddedPackages, pkg)
+		}
+		for _, imp := range b.Forward[pkg].Sorted() {
+			if !a.Forward[pkg].Has(imp) {
+				d.AddedEdges = append(d.AddedEdges, Edge{pkg, imp})
+			}
+		}
+	}
+	for _, pkg := range a.Forward.sortedPackages() {
+		if !b.Forward.Has(pkg) {
+			d.RemovedPackages = append(d.RemovedPackages, pkg)
+		} else if change, ok := locChange(pkg, a.Info[pkg], b.Info[pkg]); ok {
+			d.LOCChanges = append(d.LOCChanges, change)
+		}
+		for _, imp := range a.Forward[pkg].Sorted() {
+			if !b.Forward[pkg].Has(imp) {
+				d.RemovedEdges = append(d.RemovedEdges, Edge{pkg, imp})
+			}
+		}
+	}
+	return d
+}
+
+func locChange(pkg Package, before, after *DependencyInfo) (LOCChange, bool) {
+	if before == nil || after == nil {
+		return LOCChange{}, false
+	}
+	change := LOCChange{
+		Package:          pkg,
+		OldLOC:           before.LOC,
+		NewLOC:           after.LOC,
+		OldTransitiveLOC: before.TransitiveLOC,
+		NewTransitiveLOC: after.TransitiveLOC,
+	}
+	return change, before.LOC != after.LOC || before.TransitiveLOC != after.TransitiveLOC
+}
+
+// Empty reports whether the graphs were the same.
+func (d *GraphDiff) Empty() bool {
+	return len(d.AddedPackages) == 0 && len(d.RemovedPackages) == 0 &&
+		len(d.AddedEdges) == 0 && len(d.RemovedEdges) == 0 && len(d.LOCChanges) == 0
+}
+
+// Grown reports whether packages or edges were added.
+func (d *GraphDiff) Grown() bool {
+	return len(d.AddedPackages) != 0 || len(d.AddedEdges) != 0
+}
+
+// Graph returns the graph of the added and removed edges.
+func (d *GraphDiff) Graph() Graph {
+	g := NewGraph()
+	for _, pkg := range d.AddedPackages {
+		g.Pkg(pkg)
+	}
+	for _, pkg := range d.RemovedPackages {
+		g.Pkg(pkg)
+	}
+	for _, edges := range [][]Edge{d.AddedEdges, d.RemovedEdges} {
+		for _, e := range edges {
+			g.Pkg(e.From).Insert(e.To)
+			g.Pkg(e.To)
+		}
+	}
+	return g
+}
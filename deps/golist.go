@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// GoListLoader loads packages by running `go list -json -deps`. Every
+// invocation loads the requested package along with its dependencies, so the
+// go command only runs for packages which were not already seen, such as test
+// imports. Loads are serialized, as with PackagesLoader.
+type GoListLoader struct {
+	// Extra flags for go list, such as -tags.
+	Flags []string
+	// Environment for the go command. If nil, the current environment is used.
+	Env []string
+
+	mu       sync.Mutex
+	packages StaticLoader
+}
+
+func (l *GoListLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.packages == nil {
+		l.packages = make(StaticLoader)
+	}
+	if pkg, err := l.packages.Load(importPath, srcDir); err == nil {
+		return pkg, nil
+	}
+
+	stdout, err := l.goList(srcDir, importPath, "-json", "-deps")
+	if err != nil {
+		return nil, err
+	}
+	if err := l.packages.read(stdout); err != nil {
+		return nil, fmt.Errorf("go list %s: %v", importPath, err)
+	}
+	return l.packages.Load(importPath, srcDir)
+}
+
+// Expand lists the import paths of the packages matching the pattern.
+func (l *GoListLoader) Expand(pattern, srcDir string) ([]string, error) {
+	stdout, err := l.goList(srcDir, pattern, "-f", "{{.ImportPath}}")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(stdout.String()), nil
+}
+
+func (l *GoListLoader) goList(srcDir, pattern string, args ...string) (*bytes.Buffer, error) {
+	args = append(append([]string{"list"}, args...), l.Flags...)
+	cmd := exec.Command("go", append(args, pattern)...)
+	cmd.Dir = srcDir
+	cmd.Env = l.Env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list %s: %v: %s", pattern, err, strings.TrimSpace(stderr.String()))
+	}
+	return &stdout, nil
+}
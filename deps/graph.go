@@ -11,6 +11,7 @@ package deps
 import (
 	"bytes"
 	"fmt"
+	"sort"
 )
 
 type Graph map[Package]Set
@@ -33,6 +34,30 @@ func (pg Graph) Has(pkg Package) bool {
 	return found
 }
 
+// sortedPackages returns the packages in the graph in sorted order.
+func (pg Graph) sortedPackages() []Package {
+	pkgs := make([]Package, 0, len(pg))
+	for pkg := range pg {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i] < pkgs[j] })
+	return pkgs
+}
+
+// edges returns the packages imported by pkg, sorted unless unordered is set.
+// Unordered edges are in map iteration order, which is faster for large graphs
+// but differs between runs.
+func (pg Graph) edges(pkg Package, unordered bool) []Package {
+	if !unordered {
+		return pg[pkg].Sorted()
+	}
+	edges := make([]Package, 0, len(pg[pkg]))
+	for edge := range pg[pkg] {
+		edges = append(edges, edge)
+	}
+	return edges
+}
+
 // AddPath inserts the path into the graph.
 func (pg Graph) AddPath(path Path) {
 	var last Set
@@ -44,6 +69,32 @@ func (pg Graph) AddPath(path Path) {
 	}
 }
 
+// Reachable returns the subgraph of packages reachable from start in at most
+// maxDepth steps. If maxDepth is 0, the depth is unlimited.
+func (pg Graph) Reachable(start Package, maxDepth int) Graph {
+	if _, ok := pg[start]; !ok {
+		return nil
+	}
+
+	reachable := NewGraph()
+	reachable.Pkg(start)
+	frontier := []Package{start}
+	for depth := 0; len(frontier) > 0 && (maxDepth == 0 || depth < maxDepth); depth++ {
+		var next []Package
+		for _, pkg := range frontier {
+			for edge := range pg[pkg] {
+				if !reachable.Has(edge) {
+					next = append(next, edge)
+				}
+				reachable.Pkg(edge)
+				reachable.Pkg(pkg).Insert(edge)
+			}
+		}
+		frontier = next
+	}
+	return reachable
+}
+
 // SomePath searches the graph for any path from start to end.
 func (pg Graph) SomePath(start, end Package) Path {
 	if _, ok := pg[start]; !ok {
@@ -76,6 +127,144 @@ func (pg Graph) SomePathCond(start Package, endCond func(Package) bool) Path {
 	return fullPath
 }
 
+// ShortestPath searches the graph for a shortest path from start to end.
+func (pg Graph) ShortestPath(start, end Package) Path {
+	if _, ok := pg[start]; !ok {
+		return nil
+	} else if _, ok := pg[end]; !ok {
+		return nil
+	}
+
+	return pg.ShortestPathCond(start, func(pkg Package) bool {
+		return pkg == end
+	})
+}
+
+// ShortestPathCond searches the graph breadth first for a shortest path from
+// start to a package matching the end condition. Edges are followed in sorted
+// order, so of several shortest paths the one which sorts first is returned.
+func (pg Graph) ShortestPathCond(start Package, endCond func(Package) bool) Path {
+	if _, ok := pg[start]; !ok {
+		return nil
+	}
+	return pg.shortestPath(start, endCond, nil, nil)
+}
+
+// shortestPath is ShortestPathCond, without the removed packages and edges.
+func (pg Graph) shortestPath(start Package, endCond func(Package) bool, removed Set, removedEdges Graph) Path {
+	parents := map[Package]Package{start: NullPackage}
+	queue := []Package{start}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		if endCond(pkg) {
+			var path Path
+			for ; pkg != NullPackage; pkg = parents[pkg] {
+				path = append(Path{pkg}, path...)
+			}
+			return path
+		}
+		for _, edge := range pg[pkg].Sorted() {
+			if _, seen := parents[edge]; seen || removed.Has(edge) || removedEdges[pkg].Has(edge) {
+				continue
+			}
+			parents[edge] = pkg
+			queue = append(queue, edge)
+		}
+	}
+	return nil
+}
+
+// KShortestPaths searches the graph for the k shortest paths from start to
+// end which do not visit any package twice.
+func (pg Graph) KShortestPaths(start, end Package, k int) []Path {
+	if _, ok := pg[start]; !ok {
+		return nil
+	} else if _, ok := pg[end]; !ok {
+		return nil
+	}
+
+	return pg.KShortestPathsCond(start, func(pkg Package) bool {
+		return pkg == end
+	}, k)
+}
+
+// KShortestPathsCond searches the graph for the k shortest paths from start to
+// a package matching the end condition, using Yen's algorithm. Paths do not
+// visit any package twice, or continue past a matching package. They are
+// returned shortest first, with paths of the same length in sorted order.
+func (pg Graph) KShortestPathsCond(start Package, endCond func(Package) bool, k int) []Path {
+	if _, ok := pg[start]; !ok || k <= 0 {
+		return nil
+	}
+	first := pg.shortestPath(start, endCond, nil, nil)
+	if first == nil {
+		return nil
+	}
+
+	paths := []Path{first}
+	found := map[string]bool{pathKey(first): true}
+	var candidates []Path
+	for len(paths) < k {
+		last := paths[len(paths)-1]
+		// Find the shortest deviation from each package on the last path,
+		// which shares the path up to that package.
+		for i := 0; i < len(last)-1; i++ {
+			spur, prefix := last[i], last[:i]
+			removedEdges := NewGraph()
+			for _, p := range paths {
+				if len(p) > i+1 && pathsEqual(p[:i+1], last[:i+1]) {
+					removedEdges.Pkg(p[i]).Insert(p[i+1])
+				}
+			}
+			spurPath := pg.shortestPath(spur, endCond, NewSet(prefix...), removedEdges)
+			if spurPath == nil {
+				continue
+			}
+			candidate := append(append(Path{}, prefix...), spurPath...)
+			if key := pathKey(candidate); !found[key] {
+				found[key] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			if len(candidates[i]) != len(candidates[j]) {
+				return len(candidates[i]) < len(candidates[j])
+			}
+			return pathKey(candidates[i]) < pathKey(candidates[j])
+		})
+		paths = append(paths, candidates[0])
+		candidates = candidates[1:]
+	}
+	return paths
+}
+
+func pathsEqual(a, b Path) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pathKey returns a string identifying the path, which sorts in the same order
+// as the packages in the path.
+func pathKey(path Path) string {
+	var buf bytes.Buffer
+	for _, pkg := range path {
+		buf.WriteString(string(pkg))
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
+
 // AllPaths searches the graph for all paths from start to end.
 func (pg Graph) AllPaths(start, end Package) Graph {
 	if _, ok := pg[start]; !ok {
@@ -113,6 +302,86 @@ func (pg Graph) AllPathsCond(start Package, endCond func(Package) bool) Graph {
 	return paths
 }
 
+// MinCut returns a smallest set of imports which, if removed, would leave no
+// path from start to end. It computes a maximum flow from start to end with a
+// capacity of one per import, and returns the imports leaving the packages
+// still reachable in the residual graph, so of several smallest cuts the one
+// closest to start is returned. The imports are sorted, and nil is returned if
+// there is no path or start is end.
+func (pg Graph) MinCut(start, end Package) []Edge {
+	if start == end || !pg.Has(start) || !pg.Has(end) {
+		return nil
+	}
+	importers := NewGraph()
+	for pkg, imports := range pg {
+		for imp := range imports {
+			importers.Pkg(imp).Insert(pkg)
+		}
+	}
+
+	// The imports carrying flow.
+	flow := NewGraph()
+	type step struct {
+		from Package
+		// Whether the step cancels flow on the import from the package to from.
+		reverse bool
+	}
+	// search returns how each package reachable from start in the residual
+	// graph was reached, breadth first.
+	search := func() map[Package]step {
+		parents := map[Package]step{start: {}}
+		queue := []Package{start}
+		for len(queue) > 0 {
+			pkg := queue[0]
+			queue = queue[1:]
+			if pkg == end {
+				break
+			}
+			for _, imp := range pg[pkg].Sorted() {
+				if _, seen := parents[imp]; !seen && !flow[pkg].Has(imp) {
+					parents[imp] = step{pkg, false}
+					queue = append(queue, imp)
+				}
+			}
+			for _, importer := range importers[pkg].Sorted() {
+				if _, seen := parents[importer]; !seen && flow[importer].Has(pkg) {
+					parents[importer] = step{pkg, true}
+					queue = append(queue, importer)
+				}
+			}
+		}
+		return parents
+	}
+
+	for {
+		parents := search()
+		if _, ok := parents[end]; !ok {
+			var cut []Edge
+			for _, pkg := range pg.sortedPackages() {
+				if _, ok := parents[pkg]; !ok {
+					continue
+				}
+				for _, imp := range pg[pkg].Sorted() {
+					if _, ok := parents[imp]; !ok {
+						cut = append(cut, Edge{pkg, imp})
+					}
+				}
+			}
+			return cut
+		}
+		// Augment the flow along the path found.
+		for pkg := end; pkg != start; {
+			s := parents[pkg]
+			if s.reverse {
+				flow[pkg].Delete(s.from)
+			} else {
+				flow.Pkg(s.from).Insert(pkg)
+			}
+			pkg = s.from
+		}
+	}
+}
+
 // WalkFn is the function used for graph searches.
 // pkg is the package currently being evaluated
 // edges is the set of edges from the current package
@@ -120,8 +389,13 @@ func (pg Graph) AllPathsCond(start Package, endCond func(Package) bool) Graph {
 type WalkFn func(pkg Package, edges Set, path Path) (followEdges, continueWalk bool)
 
 // Walk the graph depth first, starting at start and calling walkFn on each node visited.
-// Each node will be visited at most once.
+// Each node will be visited at most once. Edges are followed in sorted order.
 func (pg Graph) DepthFirst(start Package, walkFn WalkFn) {
+	pg.depthFirst(start, false, walkFn)
+}
+
+// depthFirst is DepthFirst, following edges in map iteration order if unordered is set.
+func (pg Graph) depthFirst(start Package, unordered bool, walkFn WalkFn) {
 	if _, ok := pg[start]; !ok {
 		return
 	}
@@ -132,80 +406,125 @@ func (pg Graph) DepthFirst(start Package, walkFn WalkFn) {
 	}
 
 	visited := NewSet(start)
+	// The edges left to follow from each package on the path.
+	pending := map[Package][]Package{start: pg.edges(start, unordered)}
 walk:
 	for len(path) > 0 {
-		for pkg := range pg[path.Last()] {
-			if !visited.Has(pkg) {
-				visited.Insert(pkg)
-				path = append(path, pkg)
-				followEdges, continueWalk := walkFn(pkg, pg[pkg], path)
-				if !continueWalk {
-					return
-				}
-				if followEdges {
-					continue walk
-				} else {
-					path = path.Pop() // Backtrack.
-				}
+		last := path.Last()
+		for len(pending[last]) > 0 {
+			pkg := pending[last][0]
+			pending[last] = pending[last][1:]
+			if visited.Has(pkg) {
+				continue
+			}
+			visited.Insert(pkg)
+			path = append(path, pkg)
+			followEdges, continueWalk := walkFn(pkg, pg[pkg], path)
+			if !continueWalk {
+				return
 			}
+			if followEdges {
+				pending[pkg] = pg.edges(pkg, unordered)
+				continue walk
+			}
+			path = path.Pop() // Backtrack.
 		}
+		delete(pending, last)
 		path = path.Pop() // Backtrack.
 	}
 }
 
 // Walk the graph "depth last", starting at start and calling walkFn on each node visited.  Each
 // node will be visited at most once. Nodes will be visited "depth last", where depth is defined as
-// the maximum distance from the start.
+// the maximum distance from the start. Packages in an import cycle share the same depth. Nodes at
+// the same depth are visited in sorted order.
 // TODO: (if needed) add path to WalkFn
 // TODO: correctly handle !followEdges from WalkFn
 func (pg Graph) DepthLast(start Package, walkFn WalkFn) {
-	if _, ok := pg[start]; !ok {
-		return
-	}
+	pg.depthLast([]Package{start}, false, walkFn)
+}
 
-	// First, build the depth map.
-	// TODO: there's probably a more efficient algorithm than this
-	depths := map[Package]int{
-		start: 0,
-	}
-	visited := NewSet()
-	type depthPair struct {
-		p Package
-		d int
+// depthLast is DepthLast from several starting packages, which are all at depth 0. If unordered
+// is set, nodes at the same depth are visited in no particular order.
+func (pg Graph) depthLast(starts []Package, unordered bool, walkFn WalkFn) {
+	// Find the subgraph reachable from the starts.
+	reachable := NewGraph()
+	for _, start := range starts {
+		if _, ok := pg[start]; !ok || reachable.Has(start) {
+			continue
+		}
+		reachable[start] = pg[start]
+		queue := []Package{start}
+		for len(queue) > 0 {
+			pkg := queue[0]
+			queue = queue[1:]
+			for edge := range pg[pkg] {
+				if !reachable.Has(edge) {
+					reachable[edge] = pg[edge]
+					queue = append(queue, edge)
+				}
+			}
+		}
 	}
-	maxDepth := 0
-	queue := []depthPair{{start, 0}}
-	for len(queue) > 0 {
-		dp := queue[0]
-		queue = queue[1:]
 
-		if dp.d < depths[dp.p] || (visited.Has(dp.p) && dp.d == depths[dp.p]) {
-			continue
+	// The maximum distance is the longest path through the components of the
+	// subgraph, which are ordered so that every component comes after the
+	// components importing it.
+	components := reachable.stronglyConnected()
+	componentOf := make(map[Package]int, len(reachable))
+	for i, component := range components {
+		for _, pkg := range component {
+			componentOf[pkg] = i
 		}
-		visited.Insert(dp.p)
-		depths[dp.p] = dp.d
-		for pkg := range pg[dp.p] {
-			queue = append(queue, depthPair{pkg, dp.d + 1})
+	}
+	componentDepths := make([]int, len(components))
+	maxDepth := 0
+	for i := len(components) - 1; i >= 0; i-- {
+		d := componentDepths[i]
+		if maxDepth < d {
+			maxDepth = d
 		}
-		if maxDepth < dp.d {
-			maxDepth = dp.d
+		for _, pkg := range components[i] {
+			for edge := range pg[pkg] {
+				if j := componentOf[edge]; j != i && componentDepths[j] < d+1 {
+					componentDepths[j] = d + 1
+				}
+			}
 		}
 	}
 
-	for i := 0; i <= maxDepth; i++ {
-		for pkg, depth := range depths {
-			if depth == i {
-				if _, continueWalk := walkFn(pkg, pg[pkg], nil); !continueWalk {
-					return
-				}
+	levels := make([][]Package, maxDepth+1)
+	for i, component := range components {
+		d := componentDepths[i]
+		levels[d] = append(levels[d], component...)
+	}
+	for _, level := range levels {
+		if !unordered {
+			sort.Slice(level, func(i, j int) bool { return level[i] < level[j] })
+		}
+		for _, pkg := range level {
+			if _, continueWalk := walkFn(pkg, pg[pkg], nil); !continueWalk {
+				return
 			}
 		}
 	}
 }
 
-func (pg Graph) List(root Package) []Package {
+// List returns the packages reachable from the roots, ordered by their
+// maximum distance from the roots. Packages at the same distance are sorted.
+func (pg Graph) List(roots ...Package) []Package {
+	return pg.list(roots, false)
+}
+
+// ListUnordered is List without sorting the packages at the same distance,
+// which is faster for large graphs but differs between runs.
+func (pg Graph) ListUnordered(roots ...Package) []Package {
+	return pg.list(roots, true)
+}
+
+func (pg Graph) list(roots []Package, unordered bool) []Package {
 	var pkgs []Package
-	pg.DepthLast(root, func(pkg Package, _ Set, _ Path) (bool, bool) {
+	pg.depthLast(roots, unordered, func(pkg Package, _ Set, _ Path) (bool, bool) {
 		pkgs = append(pkgs, pkg)
 		return true, true
 	})
@@ -213,6 +532,38 @@ func (pg Graph) List(root Package) []Package {
 }
 
 func (pg Graph) Dot(root Package, labelFn func(Package) string) string {
+	return pg.DotRoots([]Package{root}, labelFn)
+}
+
+// DotRoots renders the packages reachable from any of the roots as a dot graph.
+// Packages and edges are rendered in depth first order, following edges in
+// sorted order.
+func (pg Graph) DotRoots(roots []Package, labelFn func(Package) string) string {
+	return pg.DotStyled(roots, DotStyle{Label: labelFn})
+}
+
+// DotStyle customizes the rendering of a dot graph.
+type DotStyle struct {
+	// Label returns the label of a package.
+	Label func(Package) string
+	// Cluster returns the name of the cluster to render the package in, or ""
+	// to render it outside of any cluster. May be nil.
+	Cluster func(Package) string
+	// NodeAttrs returns extra attributes for a package, such as
+	// `color="red"`, or "" for none. May be nil.
+	NodeAttrs func(Package) string
+	// EdgeAttrs returns extra attributes for an edge, or "" for none. May be
+	// nil.
+	EdgeAttrs func(from, to Package) string
+	// Unordered follows edges in map iteration order instead of sorted
+	// order, which is faster for large graphs but differs between runs.
+	Unordered bool
+}
+
+// DotStyled renders the packages reachable from any of the roots as a dot
+// graph, like DotRoots, with the style. Clusters are rendered first, in the
+// order their first package is reached.
+func (pg Graph) DotStyled(roots []Package, style DotStyle) string {
 	nextID := 0
 	ids := make(map[Package]int, len(pg))
 	getID := func(pkg Package) int {
@@ -225,18 +576,261 @@ func (pg Graph) Dot(root Package, labelFn func(Package) string) string {
 	}
 
 	var buf bytes.Buffer
-	buf.WriteString("digraph godeps {\n")
+	var clusters []string
+	clusterBufs := make(map[string]*bytes.Buffer)
 
-	pg.DepthFirst(root, func(pkg Package, edges Set, _ Path) (bool, bool) {
-		pkgID := getID(pkg)
-		fmt.Fprintf(&buf, "%d [label=\"%s\"];\n", pkgID, labelFn(pkg))
-		for edge := range edges {
-			fmt.Fprintf(&buf, "%d -> %d;\n", pkgID, getID(edge))
+	rendered := NewSet()
+	for _, root := range roots {
+		pg.depthFirst(root, style.Unordered, func(pkg Package, _ Set, _ Path) (bool, bool) {
+			if rendered.Has(pkg) {
+				// Already rendered from a previous root.
+				return false, true
+			}
+			rendered.Insert(pkg)
+			pkgID := getID(pkg)
+			nodeBuf := &buf
+			if style.Cluster != nil {
+				if cluster := style.Cluster(pkg); cluster != "" {
+					if _, ok := clusterBufs[cluster]; !ok {
+						clusters = append(clusters, cluster)
+						clusterBufs[cluster] = &bytes.Buffer{}
+					}
+					nodeBuf = clusterBufs[cluster]
+				}
+			}
+			attrs := ""
+			if style.NodeAttrs != nil {
+				if a := style.NodeAttrs(pkg); a != "" {
+					attrs = "," + a
+				}
+			}
+			fmt.Fprintf(nodeBuf, "%d [label=\"%s\"%s];\n", pkgID, style.Label(pkg), attrs)
+			for _, edge := range pg.edges(pkg, style.Unordered) {
+				attrs := ""
+				if style.EdgeAttrs != nil {
+					attrs = style.EdgeAttrs(pkg, edge)
+				}
+				if attrs != "" {
+					fmt.Fprintf(&buf, "%d -> %d [%s];\n", pkgID, getID(edge), attrs)
+				} else {
+					fmt.Fprintf(&buf, "%d -> %d;\n", pkgID, getID(edge))
+				}
+			}
+			return true, true
+		})
+	}
+
+	var out bytes.Buffer
+	out.WriteString("digraph godeps {\n")
+	for i, cluster := range clusters {
+		fmt.Fprintf(&out, "subgraph cluster_%d {\nlabel=%q;\n", i, cluster)
+		out.Write(clusterBufs[cluster].Bytes())
+		out.WriteString("}\n")
+	}
+	out.Write(buf.Bytes())
+	out.WriteString("}\n")
+
+	return out.String()
+}
+
+// StronglyConnectedComponents returns the strongly connected components of the
+// graph: the largest sets of packages which can all reach each other. Packages
+// which are not part of an import cycle form a component on their own. Each
+// component is sorted, and the components are sorted by their first package.
+func (pg Graph) StronglyConnectedComponents() [][]Package {
+	components := pg.stronglyConnected()
+	for _, component := range components {
+		sort.Slice(component, func(i, j int) bool { return component[i] < component[j] })
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i][0] < components[j][0] })
+	return components
+}
+
+// Cycles returns an import cycle for each strongly connected component with
+// more than one package, in the order of StronglyConnectedComponents. Each
+// cycle is a shortest path from the first package in the component back to
+// itself.
+func (pg Graph) Cycles() []Path {
+	var cycles []Path
+	for _, component := range pg.StronglyConnectedComponents() {
+		start := component[0]
+		if len(component) == 1 && !pg[start].Has(start) {
+			continue
 		}
-		return true, true
-	})
+		members := NewSet(component...)
+		sub := NewGraph()
+		for _, pkg := range component {
+			for edge := range pg[pkg] {
+				if members.Has(edge) {
+					sub.Pkg(pkg).Insert(edge)
+				}
+			}
+		}
+		path := sub.ShortestPathCond(start, func(pkg Package) bool {
+			return sub[pkg].Has(start)
+		})
+		cycles = append(cycles, append(path, start))
+	}
+	return cycles
+}
+
+// stronglyConnected returns the strongly connected components of the graph
+// using Tarjan's algorithm. Components are returned in reverse topological
+// order: every component comes after the components it has edges to.
+func (pg Graph) stronglyConnected() [][]Package {
+	var (
+		components [][]Package
+		stack      []Package
+		onStack    = NewSet()
+		index      = make(map[Package]int, len(pg))
+		lowLink    = make(map[Package]int, len(pg))
+	)
+	var connect func(pkg Package)
+	connect = func(pkg Package) {
+		index[pkg] = len(index)
+		lowLink[pkg] = index[pkg]
+		stack = append(stack, pkg)
+		onStack.Insert(pkg)
+		for edge := range pg[pkg] {
+			if _, visited := index[edge]; !visited {
+				connect(edge)
+				if lowLink[edge] < lowLink[pkg] {
+					lowLink[pkg] = lowLink[edge]
+				}
+			} else if onStack.Has(edge) && index[edge] < lowLink[pkg] {
+				lowLink[pkg] = index[edge]
+			}
+		}
+		if lowLink[pkg] != index[pkg] {
+			return
+		}
+		// pkg is the root of a component; pop it off the stack.
+		var component []Package
+		for {
+			last := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			delete(onStack, last)
+			component = append(component, last)
+			if last == pkg {
+				break
+			}
+		}
+		components = append(components, component)
+	}
+	for pkg := range pg {
+		if _, visited := index[pkg]; !visited {
+			connect(pkg)
+		}
+	}
+	return components
+}
 
-	buf.WriteString("}\n")
+// Dominators returns the immediate dominator of each package reachable from
+// the roots: the closest package which every path from the roots to the
+// package goes through. The roots, and packages with paths from several roots
+// which share no package, are mapped to NullPackage.
+func (pg Graph) Dominators(roots ...Package) map[Package]Package {
+	idom, _ := pg.dominators(roots)
+	return idom
+}
 
-	return buf.String()
+// DominatorTree returns the dominator tree of the packages reachable from the
+// roots, with an edge from each package to the packages it immediately
+// dominates. Removing a package's imports removes its subtree from the graph.
+func (pg Graph) DominatorTree(roots ...Package) Graph {
+	tree := NewGraph()
+	for pkg, dom := range pg.Dominators(roots...) {
+		tree.Pkg(pkg)
+		if dom != NullPackage {
+			tree.Pkg(dom).Insert(pkg)
+		}
+	}
+	return tree
+}
+
+// dominators computes the immediate dominator of each package reachable from
+// the roots, using the algorithm from Cooper, Harvey and Kennedy, "A Simple,
+// Fast Dominance Algorithm". The roots are treated as the successors of a
+// single virtual root, which is represented by the empty package: packages
+// which are not dominated by any other package have an immediate dominator of
+// "". The reachable packages are also returned in reverse postorder, in which
+// every package comes after its immediate dominator.
+func (pg Graph) dominators(roots []Package) (idom map[Package]Package, order []Package) {
+	const virtualRoot = NullPackage
+	succs := func(pkg Package) Set {
+		if pkg == virtualRoot {
+			s := NewSet()
+			for _, root := range roots {
+				if pg.Has(root) {
+					s.Insert(root)
+				}
+			}
+			return s
+		}
+		return pg[pkg]
+	}
+
+	// Number the packages in postorder.
+	postorder := make(map[Package]int, len(pg))
+	var visit func(pkg Package)
+	visited := NewSet()
+	visit = func(pkg Package) {
+		visited.Insert(pkg)
+		for edge := range succs(pkg) {
+			if !visited.Has(edge) {
+				visit(edge)
+			}
+		}
+		postorder[pkg] = len(order)
+		order = append(order, pkg)
+	}
+	visit(virtualRoot)
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+
+	preds := make(map[Package][]Package, len(order))
+	for _, pkg := range order {
+		for edge := range succs(pkg) {
+			preds[edge] = append(preds[edge], pkg)
+		}
+	}
+
+	intersect := func(a, b Package) Package {
+		for a != b {
+			for postorder[a] < postorder[b] {
+				a = idom[a]
+			}
+			for postorder[b] < postorder[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	idom = map[Package]Package{virtualRoot: virtualRoot}
+	for changed := true; changed; {
+		changed = false
+		for _, pkg := range order[1:] {
+			var newIdom Package
+			processed := false
+			for _, pred := range preds[pkg] {
+				if _, ok := idom[pred]; !ok {
+					continue
+				}
+				if !processed {
+					newIdom = pred
+					processed = true
+				} else {
+					newIdom = intersect(pred, newIdom)
+				}
+			}
+			if old, ok := idom[pkg]; !ok || old != newIdom {
+				idom[pkg] = newIdom
+				changed = true
+			}
+		}
+	}
+	delete(idom, virtualRoot)
+	return idom, order[1:]
 }
@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import "encoding/json"
+
+// JSONResult is the JSON schema for dependency graphs and query results.
+// Packages and edges are sorted, so the encoding is stable.
+//
+//	{
+//	  "roots": ["example.com/cmd/server"],
+//	  "packages": [
+//	    {"package": "example.com/cmd/server", "loc": 120, "transitiveLoc": 450, "exclusiveLoc": 450},
+//	    {"package": "net/http", "loc": 300, "transitiveLoc": 300, "exclusiveLoc": 300, "stdlib": true}
+//	  ],
+//	  "edges": [{"from": "example.com/cmd/server", "to": "net/http", "positions": ["main.go:5"], "exclusiveLoc": 300}],
+//	  "ignored": ["errors"],
+//	  "paths": [{"from": "example.com/cmd/server", "to": "net/http", "path": ["example.com/cmd/server", "net/http"]}]
+//	}
+type JSONResult struct {
+	// The packages the graph or query starts from.
+	Roots []Package `json:"roots"`
+	// The packages in the graph, with their metadata.
+	Packages []JSONPackage `json:"packages"`
+	// The imports between packages in the graph.
+	Edges []JSONEdge `json:"edges"`
+	// Packages which were excluded from the graph.
+	Ignored []Package `json:"ignored,omitempty"`
+	// For path queries, the paths found, each from a root to a target.
+	Paths []JSONPath `json:"paths,omitempty"`
+}
+
+type JSONPackage struct {
+	Package       Package `json:"package"`
+	LOC           int     `json:"loc"`
+	TransitiveLOC int     `json:"transitiveLoc"`
+	ExclusiveLOC  int     `json:"exclusiveLoc"`
+	Stdlib        bool    `json:"stdlib,omitempty"`
+	TestOnly      bool    `json:"testOnly,omitempty"`
+}
+
+// JSONPath is a path found by a path query, with the root and the target it
+// was found for.
+type JSONPath struct {
+	From Package `json:"from"`
+	// The target package, or the expression of a -toregex query.
+	To   string `json:"to"`
+	Path Path   `json:"path"`
+}
+
+type JSONEdge struct {
+	From Package `json:"from"`
+	To   Package `json:"to"`
+	// The positions of the import specs, if known.
+	Positions []ImportPos `json:"positions,omitempty"`
+	// The symbols used by the importer, if they were loaded.
+	Symbols []SymbolUse `json:"symbols,omitempty"`
+	// The build constraint under which the package is imported, if any.
+	Constraint string `json:"constraint,omitempty"`
+	// Which files of the importer make the import: "test" or "xtest" for
+	// test imports, omitted for production imports.
+	Kind EdgeKind `json:"kind,omitempty"`
+	// The lines of code dropped if the import were removed, omitted if none.
+	ExclusiveLOC int `json:"exclusiveLoc,omitempty"`
+}
+
+// NewJSONResult returns the JSON representation of the graph, which may be a
+// query result from the dependencies.
+func (d Dependencies) NewJSONResult(roots []Package, g Graph, paths []JSONPath) *JSONResult {
+	r := &JSONResult{
+		Roots:   roots,
+		Ignored: d.Ignored.Sorted(),
+		Paths:   paths,
+	}
+	for _, pkg := range g.sortedPackages() {
+		p := JSONPackage{Package: pkg}
+		if info, ok := d.Info[pkg]; ok {
+			p.LOC = info.LOC
+			p.TransitiveLOC = info.TransitiveLOC
+			p.ExclusiveLOC = info.ExclusiveLOC
+			p.Stdlib = info.Stdlib
+			p.TestOnly = info.TestOnly
+		}
+		r.Packages = append(r.Packages, p)
+		for _, imp := range g[pkg].Sorted() {
+			e := JSONEdge{From: pkg, To: imp}
+			if info, ok := d.EdgeInfo[Edge{pkg, imp}]; ok {
+				e.Positions = info.Positions
+				e.Symbols = info.Symbols
+				e.Constraint = info.Constraint
+				e.Kind = info.Kind
+				e.ExclusiveLOC = info.ExclusiveLOC
+			}
+			r.Edges = append(r.Edges, e)
+		}
+	}
+	if r.Roots == nil {
+		r.Roots = []Package{}
+	}
+	if r.Packages == nil {
+		r.Packages = []JSONPackage{}
+	}
+	if r.Edges == nil {
+		r.Edges = []JSONEdge{}
+	}
+	return r
+}
+
+// Dependencies returns the dependencies described by the result.
+func (r *JSONResult) Dependencies() Dependencies {
+	d := Dependencies{
+		Roots:    r.Roots,
+		Forward:  NewGraph(),
+		Reverse:  NewGraph(),
+		Ignored:  NewSet(r.Ignored...),
+		Info:     make(map[Package]*DependencyInfo, len(r.Packages)),
+		EdgeInfo: make(map[Edge]*EdgeInfo),
+	}
+	for _, p := range r.Packages {
+		d.Forward.Pkg(p.Package)
+		d.Reverse.Pkg(p.Package)
+		d.Info[p.Package] = &DependencyInfo{
+			LOC:           p.LOC,
+			TransitiveLOC: p.TransitiveLOC,
+			ExclusiveLOC:  p.ExclusiveLOC,
+			Stdlib:        p.Stdlib,
+			TestOnly:      p.TestOnly,
+		}
+	}
+	for _, e := range r.Edges {
+		d.Forward.Pkg(e.From).Insert(e.To)
+		d.Reverse.Pkg(e.To).Insert(e.From)
+		if len(e.Positions) > 0 || len(e.Symbols) > 0 || e.Constraint != "" || e.Kind != ProdEdge || e.ExclusiveLOC != 0 {
+			d.EdgeInfo[Edge{e.From, e.To}] = &EdgeInfo{
+				Positions:    e.Positions,
+				Symbols:      e.Symbols,
+				Constraint:   e.Constraint,
+				Kind:         e.Kind,
+				ExclusiveLOC: e.ExclusiveLOC,
+			}
+		}
+	}
+	return d
+}
+
+// MarshalJSON encodes the dependencies as a JSONResult.
+func (d Dependencies) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.NewJSONResult(d.Roots, d.Forward, nil))
+}
+
+// UnmarshalJSON decodes dependencies encoded as a JSONResult.
+func (d *Dependencies) UnmarshalJSON(data []byte) error {
+	var r JSONResult
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	*d = r.Dependencies()
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"path/filepath"
+	"strconv"
+)
+
+// LoadedPackage is the import data of a single package.
+// The field names match the output of `go list -json`, so that output can be
+// decoded directly into LoadedPackages.
+type LoadedPackage struct {
+	// The import path of the package. It may include a vendor directory.
+	ImportPath string
+	// The directory containing the package sources.
+	Dir string
+	// Whether the package is part of the Go standard library.
+	Standard bool
+
+	// Imports of the package, its internal tests and its external tests.
+	// All imports must be loadable by the Loader which returned the package.
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+
+	// Source file names, relative to Dir.
+	GoFiles      []string
+	CgoFiles     []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+	// Go files excluded by build constraints, which may still be parsed for
+	// the constraints on their imports.
+	IgnoredGoFiles []string
+
+	// Whether the source files can not be read, as for packages recorded on
+	// another machine. The files in Dir are then never read: lines of code
+	// come from FileLOC, and import positions from ImportPos, TestImportPos
+	// and XTestImportPos.
+	NoSources bool `json:",omitempty"`
+
+	// Lines of code of each source file. Files which are missing are read
+	// from Dir.
+	FileLOC map[string]int `json:",omitempty"`
+
+	// Positions of the import specs of each import of the package, its
+	// internal tests and its external tests. If nil, they are parsed from the
+	// files in Dir.
+	ImportPos      map[string][]token.Position `json:",omitempty"`
+	TestImportPos  map[string][]token.Position `json:",omitempty"`
+	XTestImportPos map[string][]token.Position `json:",omitempty"`
+}
+
+// parseImportPos parses the imports of the files in dir, and returns the
+// positions of the import specs of each import path.
+func parseImportPos(dir string, files []string) (map[string][]token.Position, error) {
+	fset := token.NewFileSet()
+	importPos := make(map[string][]token.Position)
+	for _, file := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, file), nil, parser.ImportsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			importPos[path] = append(importPos[path], fset.Position(spec.Pos()))
+		}
+	}
+	return importPos, nil
+}
+
+// importPositions returns the import positions of the package, its internal
+// tests and its external tests. If the loader did not record them, they are
+// parsed from the source files.
+func (p *LoadedPackage) importPositions() (importPos, testImportPos, xtestImportPos map[string][]token.Position, err error) {
+	if p.ImportPos != nil || p.TestImportPos != nil || p.XTestImportPos != nil || p.NoSources || p.Dir == "" {
+		return p.ImportPos, p.TestImportPos, p.XTestImportPos, nil
+	}
+	if importPos, err = parseImportPos(p.Dir, append(append([]string{}, p.GoFiles...), p.CgoFiles...)); err != nil {
+		return nil, nil, nil, err
+	}
+	if testImportPos, err = parseImportPos(p.Dir, p.TestGoFiles); err != nil {
+		return nil, nil, nil, err
+	}
+	if xtestImportPos, err = parseImportPos(p.Dir, p.XTestGoFiles); err != nil {
+		return nil, nil, nil, err
+	}
+	return importPos, testImportPos, xtestImportPos, nil
+}
+
+// Loader discovers packages and their imports. Loaders used by a Builder with
+// more than one job must be safe for concurrent use.
+type Loader interface {
+	// Load resolves the import path and returns the package's import data.
+	// Local import paths are relative to srcDir.
+	Load(importPath, srcDir string) (*LoadedPackage, error)
+}
+
+// BuildLoader loads packages with a go/build context, searching GOROOT,
+// GOPATH and vendor directories.
+type BuildLoader struct {
+	Context build.Context
+}
+
+func (l *BuildLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	pkg, err := l.Context.Import(importPath, srcDir, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newLoadedPackage(pkg), nil
+}
+
+// ModuleLoader loads packages with a go/build context, resolving packages
+// outside of the standard library through a module build list.
+type ModuleLoader struct {
+	Modules *Modules
+	Context build.Context
+}
+
+func (l *ModuleLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	pkg, err := l.Modules.Import(importPath, srcDir, l.Context, 0)
+	if err != nil {
+		return nil, err
+	}
+	loaded := newLoadedPackage(pkg)
+	resolveStdVendor(loaded, l.Context)
+	return loaded, nil
+}
+
+func newLoadedPackage(pkg *build.Package) *LoadedPackage {
+	return &LoadedPackage{
+		ImportPath:   pkg.ImportPath,
+		Dir:          pkg.Dir,
+		Standard:     pkg.Goroot,
+		Imports:      pkg.Imports,
+		TestImports:  pkg.TestImports,
+		XTestImports: pkg.XTestImports,
+		GoFiles:      pkg.GoFiles,
+		CgoFiles:     pkg.CgoFiles,
+		TestGoFiles:  pkg.TestGoFiles,
+		XTestGoFiles: pkg.XTestGoFiles,
+
+		IgnoredGoFiles: pkg.IgnoredGoFiles,
+		ImportPos:      pkg.ImportPos,
+		TestImportPos:  pkg.TestImportPos,
+		XTestImportPos: pkg.XTestImportPos,
+	}
+}
+
+// StaticLoader serves a fixed set of packages, keyed by import path.
+type StaticLoader map[string]*LoadedPackage
+
+// ReadPackages reads a stream of JSON encoded LoadedPackages, such as the
+// output of `go list -json -deps` or a recorded fixture.
+func ReadPackages(r io.Reader) (StaticLoader, error) {
+	loader := make(StaticLoader)
+	if err := loader.read(r); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+func (l StaticLoader) read(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var pkg struct {
+			LoadedPackage
+			// Set by go list for test variants, which are not packages of their own.
+			ForTest string
+			Error   *struct{ Err string }
+		}
+		err := dec.Decode(&pkg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pkg.Error != nil {
+			return fmt.Errorf("%s: %s", pkg.ImportPath, pkg.Error.Err)
+		}
+		if pkg.ForTest != "" {
+			continue
+		}
+		p := pkg.LoadedPackage
+		l[p.ImportPath] = &p
+	}
+}
+
+func (l StaticLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	if build.IsLocalImport(importPath) {
+		dir := filepath.Join(srcDir, importPath)
+		for _, pkg := range l {
+			if pkg.Dir == dir {
+				return pkg, nil
+			}
+		}
+		return nil, fmt.Errorf("no package in directory %s", dir)
+	}
+	if pkg, ok := l[importPath]; ok {
+		return pkg, nil
+	}
+	return nil, fmt.Errorf("cannot find package %q", importPath)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"fmt"
+	"go/build"
+	"strings"
+)
+
+// Platform is a target operating system and architecture, with extra build
+// tags. Empty fields default to those of the context it is applied to.
+type Platform struct {
+	GOOS   string
+	GOARCH string
+	Tags   []string
+}
+
+// ParsePlatform parses a platform of the form "goos/goarch", optionally
+// followed by comma separated build tags, such as "linux/amd64,netgo".
+func ParsePlatform(s string) (Platform, error) {
+	fields := strings.Split(s, ",")
+	parts := strings.Split(fields[0], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected goos/goarch", s)
+	}
+	p := Platform{GOOS: parts[0], GOARCH: parts[1]}
+	for _, tag := range fields[1:] {
+		if tag == "" {
+			return Platform{}, fmt.Errorf("invalid platform %q: empty build tag", s)
+		}
+		p.Tags = append(p.Tags, tag)
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	return strings.Join(append([]string{p.GOOS + "/" + p.GOARCH}, p.Tags...), ",")
+}
+
+// Context returns the build context for the platform, based on ctx. Like the
+// go command, cgo is disabled when cross compiling.
+func (p Platform) Context(ctx build.Context) build.Context {
+	if p.GOOS != "" && p.GOOS != ctx.GOOS || p.GOARCH != "" && p.GOARCH != ctx.GOARCH {
+		ctx.CgoEnabled = false
+	}
+	if p.GOOS != "" {
+		ctx.GOOS = p.GOOS
+	}
+	if p.GOARCH != "" {
+		ctx.GOARCH = p.GOARCH
+	}
+	ctx.BuildTags = append(append([]string{}, ctx.BuildTags...), p.Tags...)
+	return ctx
+}
+
+// Env returns the environment for running the go command for the platform,
+// based on env.
+func (p Platform) Env(env []string) []string {
+	env = append([]string{}, env...)
+	if p.GOOS != "" {
+		env = append(env, "GOOS="+p.GOOS)
+	}
+	if p.GOARCH != "" {
+		env = append(env, "GOARCH="+p.GOARCH)
+	}
+	return env
+}
+
+// Matrix records which of several graphs of the same roots, such as the
+// graphs for different platforms, include each package and import.
+type Matrix struct {
+	// The names of the graphs.
+	Names []string
+	// The indexes of the graphs which include each package and import, in
+	// increasing order.
+	Packages map[Package][]int
+	Edges    map[Edge][]int
+}
+
+// NewMatrix records the packages and imports of the named graphs.
+func NewMatrix(names []string, graphs []Dependencies) *Matrix {
+	m := &Matrix{
+		Names:    names,
+		Packages: make(map[Package][]int),
+		Edges:    make(map[Edge][]int),
+	}
+	for i, d := range graphs {
+		for pkg, imports := range d.Forward {
+			m.Packages[pkg] = append(m.Packages[pkg], i)
+			for imp := range imports {
+				e := Edge{pkg, imp}
+				m.Edges[e] = append(m.Edges[e], i)
+			}
+		}
+	}
+	return m
+}
+
+// Specific returns the packages and imports which are not in every graph,
+// sorted.
+func (m *Matrix) Specific() ([]Package, []Edge) {
+	pkgs := []Package{}
+	edges := []Edge{}
+	g := m.Graph()
+	for _, pkg := range g.sortedPackages() {
+		if len(m.Packages[pkg]) < len(m.Names) {
+			pkgs = append(pkgs, pkg)
+		}
+		for _, imp := range g[pkg].Sorted() {
+			if len(m.Edges[Edge{pkg, imp}]) < len(m.Names) {
+				edges = append(edges, Edge{pkg, imp})
+			}
+		}
+	}
+	return pkgs, edges
+}
+
+// In returns the names of the graphs with the given indexes.
+func (m *Matrix) In(indexes []int) []string {
+	names := make([]string, len(indexes))
+	for i, index := range indexes {
+		names[i] = m.Names[index]
+	}
+	return names
+}
+
+// Graph returns the union of the graphs.
+func (m *Matrix) Graph() Graph {
+	g := NewGraph()
+	for pkg := range m.Packages {
+		g.Pkg(pkg)
+	}
+	for e := range m.Edges {
+		g.Pkg(e.From).Insert(e.To)
+	}
+	return g
+}
@@ -0,0 +1,403 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Module is a module in the build list.
+type Module struct {
+	// The module path.
+	Path string
+	// The selected version. Empty for the main module.
+	Version string
+	// The directory holding the module's source, after applying replacements.
+	Dir string
+}
+
+// Modules resolves import paths through the build list of a main module, as
+// described by its go.mod file and the go.mod files of its dependencies.
+type Modules struct {
+	// The main module.
+	Main Module
+	// The selected modules, including the main module, keyed by module path.
+	List map[string]Module
+
+	modCache string
+	replace  map[module.Version]module.Version
+	exclude  map[module.Version]bool
+}
+
+// FindModuleRoot returns the directory containing the go.mod file governing
+// dir, or the empty string if dir is not inside a module.
+func FindModuleRoot(dir string) string {
+	dir = filepath.Clean(dir)
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// DefaultModCache returns the module cache directory used by the go tool.
+func DefaultModCache() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := filepath.SplitList(build.Default.GOPATH)
+	if len(gopath) == 0 {
+		return ""
+	}
+	return filepath.Join(gopath[0], "pkg", "mod")
+}
+
+// LoadModules reads the go.mod file governing dir and computes the build list
+// using minimal version selection. Replace and exclude directives of the main
+// module are honored. Module sources are looked up in modCache, or in
+// DefaultModCache() if modCache is empty; nothing is downloaded. The main
+// module's vendor directory is ignored, as with -mod=mod.
+func LoadModules(dir, modCache string) (*Modules, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root := FindModuleRoot(dir)
+	if root == "" {
+		return nil, fmt.Errorf("no go.mod file found in %q or any parent directory", dir)
+	}
+	if modCache == "" {
+		modCache = DefaultModCache()
+	}
+	if modCache, err = filepath.Abs(modCache); err != nil {
+		return nil, err
+	}
+
+	mainFile, err := readModFile(filepath.Join(root, "go.mod"), modfile.Parse)
+	if err != nil {
+		return nil, err
+	}
+	if mainFile.Module == nil {
+		return nil, fmt.Errorf("%s: missing module statement", filepath.Join(root, "go.mod"))
+	}
+
+	m := &Modules{
+		Main:     Module{Path: mainFile.Module.Mod.Path, Dir: root},
+		List:     make(map[string]Module),
+		modCache: modCache,
+		replace:  make(map[module.Version]module.Version),
+		exclude:  make(map[module.Version]bool),
+	}
+	for _, r := range mainFile.Replace {
+		m.replace[r.Old] = r.New
+	}
+	for _, e := range mainFile.Exclude {
+		m.exclude[e.Mod] = true
+	}
+
+	selected, err := m.selectVersions(mainFile)
+	if err != nil {
+		return nil, err
+	}
+
+	m.List[m.Main.Path] = m.Main
+	for path, version := range selected {
+		if path == m.Main.Path {
+			continue
+		}
+		m.List[path] = Module{
+			Path:    path,
+			Version: version,
+			Dir:     m.moduleDir(module.Version{Path: path, Version: version}),
+		}
+	}
+	return m, nil
+}
+
+// selectVersions walks the module requirement graph and returns the maximum
+// required version of each module, ignoring excluded versions. Following the
+// go tool, the requirements of dependencies which declare go 1.17 or later are
+// pruned when the main module also does.
+func (m *Modules) selectVersions(mainFile *modfile.File) (map[string]string, error) {
+	pruning := mainFile.Go != nil && goAtLeast(mainFile.Go.Version, "1.17")
+
+	type item struct {
+		mod    module.Version
+		expand bool
+	}
+	var queue []item
+	for _, r := range mainFile.Require {
+		queue = append(queue, item{r.Mod, true})
+	}
+
+	selected := make(map[string]string)
+	expanded := make(map[module.Version]bool)
+	seen := make(map[module.Version]bool)
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+
+		mod := it.mod
+		if m.exclude[mod] || mod.Path == m.Main.Path {
+			// As in the go tool since Go 1.16, requirements on excluded
+			// versions are ignored.
+			continue
+		}
+		if cur, ok := selected[mod.Path]; !ok || semver.Compare(mod.Version, cur) > 0 {
+			selected[mod.Path] = mod.Version
+		}
+		if expanded[mod] || (!it.expand && seen[mod]) {
+			continue
+		}
+		seen[mod] = true
+		if !it.expand {
+			continue
+		}
+		expanded[mod] = true
+
+		f, err := m.readDepModFile(mod)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			// No go.mod file, so no requirements.
+			continue
+		}
+		followReqs := !(pruning && f.Go != nil && goAtLeast(f.Go.Version, "1.17"))
+		for _, r := range f.Require {
+			queue = append(queue, item{r.Mod, followReqs})
+		}
+	}
+	return selected, nil
+}
+
+// replacement returns the replacement for mod, if any. A replacement with an
+// empty version refers to a local directory.
+func (m *Modules) replacement(mod module.Version) (module.Version, bool) {
+	if r, ok := m.replace[mod]; ok {
+		return r, true
+	}
+	r, ok := m.replace[module.Version{Path: mod.Path}]
+	return r, ok
+}
+
+// moduleDir returns the source directory for the module version.
+func (m *Modules) moduleDir(mod module.Version) string {
+	if r, ok := m.replacement(mod); ok {
+		if r.Version == "" {
+			return m.localDir(r.Path)
+		}
+		mod = r
+	}
+	path, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return ""
+	}
+	version, err := module.EscapeVersion(mod.Version)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(m.modCache, path+"@"+version)
+}
+
+func (m *Modules) localDir(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(m.Main.Dir, path)
+}
+
+// readDepModFile reads the go.mod file for a dependency, or returns nil if
+// the dependency does not have one.
+func (m *Modules) readDepModFile(mod module.Version) (*modfile.File, error) {
+	var file string
+	if r, ok := m.replacement(mod); ok && r.Version == "" {
+		file = filepath.Join(m.localDir(r.Path), "go.mod")
+	} else {
+		if ok {
+			mod = r
+		}
+		path, err := module.EscapePath(mod.Path)
+		if err != nil {
+			return nil, err
+		}
+		version, err := module.EscapeVersion(mod.Version)
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(m.modCache, "cache", "download", path, "@v", version+".mod")
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			file = filepath.Join(m.modCache, path+"@"+version, "go.mod")
+		}
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, nil
+	}
+	// Only the main module's replace and exclude directives apply.
+	return readModFile(file, modfile.ParseLax)
+}
+
+func readModFile(file string, parse func(string, []byte, modfile.VersionFixer) (*modfile.File, error)) (*modfile.File, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parse(file, data, nil)
+}
+
+func goAtLeast(version, min string) bool {
+	return semver.Compare("v"+version, "v"+min) >= 0
+}
+
+// lookup returns the module providing the package, and the package directory.
+// When several module paths are prefixes of the import path, the longest one
+// containing the package directory wins.
+func (m *Modules) lookup(importPath string) (Module, string, bool) {
+	var (
+		best    Module
+		bestDir string
+		found   bool
+	)
+	for path, mod := range m.List {
+		if importPath != path && !strings.HasPrefix(importPath, path+"/") {
+			continue
+		}
+		if found && len(path) <= len(best.Path) {
+			continue
+		}
+		dir := filepath.Join(mod.Dir, filepath.FromSlash(strings.TrimPrefix(importPath, path)))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		best, bestDir, found = mod, dir, true
+	}
+	return best, bestDir, found
+}
+
+// importPathForDir returns the import path of the package in dir, which must
+// be inside one of the modules in the build list.
+func (m *Modules) importPathForDir(dir string) (Package, bool) {
+	var (
+		best  Package
+		depth = -1
+	)
+	for path, mod := range m.List {
+		rel, err := filepath.Rel(mod.Dir, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		// Prefer the innermost module containing the directory.
+		if d := len(mod.Dir); d > depth {
+			depth = d
+			best = Package(path)
+			if rel != "." {
+				best = Package(path + "/" + filepath.ToSlash(rel))
+			}
+		}
+	}
+	return best, depth >= 0
+}
+
+// Resolve resolves an import path, or a path relative to srcDir, to its
+// canonical import path.
+func (m *Modules) Resolve(importPath, srcDir string, bctx build.Context) (Package, error) {
+	pkg, err := m.Import(importPath, srcDir, bctx, build.FindOnly)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %q: %v", importPath, err)
+	}
+	return stripVendor(pkg.ImportPath), nil
+}
+
+// Import is like build.Context.Import, but resolves packages outside of the
+// standard library through the module build list.
+func (m *Modules) Import(importPath, srcDir string, bctx build.Context, mode build.ImportMode) (*build.Package, error) {
+	if build.IsLocalImport(importPath) {
+		dir := filepath.Join(srcDir, importPath)
+		path, ok := m.importPathForDir(dir)
+		if !ok {
+			return nil, fmt.Errorf("directory %s is outside the modules in the build list", dir)
+		}
+		return m.importDir(bctx, string(path), dir, mode)
+	}
+
+	if isDir(filepath.Join(bctx.GOROOT, "src", importPath)) {
+		return bctx.Import(importPath, "", mode)
+	}
+
+	// Packages vendored into the standard library are only visible from it,
+	// where they take precedence over the build list.
+	if vendored, ok := stdVendorPath(importPath, srcDir, bctx); ok {
+		return bctx.Import(vendored, "", mode)
+	}
+
+	if _, dir, ok := m.lookup(importPath); ok {
+		return m.importDir(bctx, importPath, dir, mode)
+	}
+
+	return nil, fmt.Errorf("no module in the build list of %s provides package %q", m.Main.Path, importPath)
+}
+
+func (m *Modules) importDir(bctx build.Context, importPath, dir string, mode build.ImportMode) (*build.Package, error) {
+	pkg, err := bctx.ImportDir(dir, mode)
+	if pkg != nil {
+		pkg.ImportPath = importPath
+	}
+	return pkg, err
+}
+
+// resolveStdVendor rewrites the imports of a standard library package which
+// refer to packages vendored into GOROOT/src/vendor to the import paths of the
+// vendored packages, such as "vendor/golang.org/x/net/http/httpguts", as go
+// list reports them.
+func resolveStdVendor(pkg *LoadedPackage, bctx build.Context) {
+	if !pkg.Standard {
+		return
+	}
+	for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+		for i, imp := range imports {
+			if isDir(filepath.Join(bctx.GOROOT, "src", imp)) {
+				continue
+			}
+			if vendored, ok := stdVendorPath(imp, pkg.Dir, bctx); ok {
+				imports[i] = vendored
+			}
+		}
+	}
+}
+
+// stdVendorPath returns the import path of the package in GOROOT/src/vendor
+// which importPath refers to from srcDir, if srcDir is in the standard library.
+func stdVendorPath(importPath, srcDir string, bctx build.Context) (string, bool) {
+	goroot := filepath.Join(bctx.GOROOT, "src")
+	rel, err := filepath.Rel(goroot, srcDir)
+	if srcDir == "" || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	vendored := "vendor/" + importPath
+	return vendored, isDir(filepath.Join(goroot, filepath.FromSlash(vendored)))
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// PackagesLoader loads packages with golang.org/x/tools/go/packages. Like
+// GoListLoader, each load also loads all dependencies of the package. Loads
+// are serialized, so a Builder's Jobs do not load packages in parallel: the
+// first load reads the whole graph, and later ones are mostly served from it.
+type PackagesLoader struct {
+	// The configuration for loading packages. Mode and Tests are overridden.
+	Config packages.Config
+	// Whether to load test imports. go/packages only reports tests for the
+	// requested packages, so this requires loading dependencies again.
+	Tests bool
+
+	mu       sync.Mutex
+	packages StaticLoader
+	// Packages which were loaded with their tests.
+	tested map[string]bool
+}
+
+const packagesLoadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+
+func (l *PackagesLoader) Load(importPath, srcDir string) (*LoadedPackage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.packages == nil {
+		l.packages = make(StaticLoader)
+		l.tested = make(map[string]bool)
+	}
+	if pkg, err := l.packages.Load(importPath, srcDir); err == nil && (!l.Tests || l.tested[pkg.ImportPath]) {
+		return pkg, nil
+	}
+
+	if err := l.load(srcDir, importPath); err != nil {
+		return nil, fmt.Errorf("unable to load %q: %v", importPath, err)
+	}
+	if l.Tests {
+		// Load the tests of all new dependencies at once, rather than one
+		// package at a time as the Builder asks for them.
+		var untested []string
+		for path := range l.packages {
+			if !l.tested[path] {
+				untested = append(untested, path)
+			}
+		}
+		if err := l.load(srcDir, untested...); err != nil {
+			return nil, fmt.Errorf("unable to load tests for dependencies of %q: %v", importPath, err)
+		}
+	}
+	return l.packages.Load(importPath, srcDir)
+}
+
+// Expand returns the import paths of the packages matching the pattern.
+func (l *PackagesLoader) Expand(pattern, srcDir string) ([]string, error) {
+	cfg := l.Config
+	cfg.Mode = packages.NeedName
+	cfg.Tests = false
+	if cfg.Dir == "" {
+		cfg.Dir = srcDir
+	}
+	pkgs, err := packages.Load(&cfg, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, p := range pkgs {
+		matches = append(matches, p.PkgPath)
+	}
+	return matches, nil
+}
+
+// load loads the packages matching the patterns, along with their
+// dependencies.
+func (l *PackagesLoader) load(srcDir string, patterns ...string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	cfg := l.Config
+	cfg.Mode = packagesLoadMode
+	cfg.Tests = l.Tests
+	if cfg.Dir == "" {
+		cfg.Dir = srcDir
+	}
+	roots, err := packages.Load(&cfg, patterns...)
+	if err != nil {
+		return err
+	}
+
+	// Test variants are reported as separate packages, and are folded into
+	// the package under test once everything has been visited.
+	var tests, xtests []*packages.Package
+	var loadErr error
+	packages.Visit(roots, nil, func(p *packages.Package) {
+		for _, e := range p.Errors {
+			if e.Kind == packages.ListError && loadErr == nil {
+				loadErr = e
+			}
+		}
+		forTest, ok := testVariantOf(p)
+		switch {
+		case !ok:
+			if _, seen := l.packages[p.PkgPath]; !seen {
+				l.packages[p.PkgPath] = newPackagesLoadedPackage(p)
+			}
+		case p.PkgPath == forTest:
+			tests = append(tests, p)
+		case p.PkgPath == forTest+"_test":
+			xtests = append(xtests, p)
+		}
+		// Other variants are dependencies recompiled for a test, or the
+		// generated test main package.
+	})
+	if loadErr != nil {
+		return loadErr
+	}
+
+	for _, t := range tests {
+		pkg, ok := l.packages[t.PkgPath]
+		if !ok {
+			continue
+		}
+		pkg.TestImports = difference(importPaths(t), pkg.Imports)
+		pkg.TestGoFiles = difference(baseNames(t.GoFiles), pkg.GoFiles)
+	}
+	for _, t := range xtests {
+		pkg, ok := l.packages[strings.TrimSuffix(t.PkgPath, "_test")]
+		if !ok {
+			continue
+		}
+		pkg.XTestImports = importPaths(t)
+		pkg.XTestGoFiles = baseNames(t.GoFiles)
+	}
+	for _, root := range roots {
+		if _, isTest := testVariantOf(root); !isTest {
+			l.tested[root.PkgPath] = l.Tests
+		}
+	}
+	return nil
+}
+
+// testVariantOf reports whether p only exists for testing and, for test
+// variants, returns the package under test. Test variants have IDs of the
+// form "path [forTest.test]", and the generated test main has a path ending
+// in ".test".
+func testVariantOf(p *packages.Package) (forTest string, isTest bool) {
+	if strings.HasSuffix(p.PkgPath, ".test") {
+		return "", true
+	}
+	i := strings.Index(p.ID, " [")
+	if i < 0 {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(p.ID[i+len(" ["):], "]"), ".test"), true
+}
+
+func newPackagesLoadedPackage(p *packages.Package) *LoadedPackage {
+	dir := p.Dir
+	if dir == "" && len(p.GoFiles) > 0 {
+		dir = filepath.Dir(p.GoFiles[0])
+	}
+	goroot := filepath.Join(build.Default.GOROOT, "src") + string(filepath.Separator)
+	return &LoadedPackage{
+		ImportPath: p.PkgPath,
+		Dir:        dir,
+		Standard:   strings.HasPrefix(dir, goroot),
+		Imports:    importPaths(p),
+		GoFiles:    baseNames(p.GoFiles),
+
+		IgnoredGoFiles: goFiles(baseNames(p.IgnoredFiles)),
+	}
+}
+
+// goFiles returns the names of the Go files in files.
+func goFiles(files []string) []string {
+	var gofiles []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".go") {
+			gofiles = append(gofiles, f)
+		}
+	}
+	return gofiles
+}
+
+func importPaths(p *packages.Package) []string {
+	var imports []string
+	for _, imp := range p.Imports {
+		imports = append(imports, imp.PkgPath)
+	}
+	return imports
+}
+
+func baseNames(files []string) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	return names
+}
+
+// difference returns the elements of a which are not in b.
+func difference(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+	}
+	var diff []string
+	for _, s := range a {
+		if !inB[s] {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
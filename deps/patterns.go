@@ -0,0 +1,241 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"go/build"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Expander is implemented by Loaders which can expand package patterns.
+type Expander interface {
+	// Expand returns the packages matching the pattern, as import paths or as
+	// local paths relative to srcDir.
+	Expand(pattern, srcDir string) ([]string, error)
+}
+
+// IsPattern reports whether the import path is a pattern, such as
+// "github.com/org/repo/..." or "./pkg/...".
+func IsPattern(importPath string) bool {
+	return strings.Contains(importPath, "...")
+}
+
+// matchPattern returns a function which reports whether an import path
+// matches the pattern, following the rules of the go tool: "..." matches any
+// string, and "foo/..." also matches "foo". Unless the pattern mentions
+// vendor, "..." does not match vendored packages.
+func matchPattern(pattern string) func(name string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	reg := regexp.MustCompile(`^` + re + `$`)
+	matchVendor := hasPathElement(pattern, "vendor")
+	return func(name string) bool {
+		if !matchVendor && hasPathElement(name, "vendor") {
+			return false
+		}
+		return reg.MatchString(name)
+	}
+}
+
+func hasPathElement(p, elem string) bool {
+	for _, e := range strings.Split(p, "/") {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// patternRoot returns the longest directory prefix of the pattern without
+// wildcards.
+func patternRoot(pattern string) string {
+	prefix := pattern[:strings.Index(pattern, "...")]
+	if strings.HasSuffix(prefix, "/") {
+		return strings.TrimSuffix(prefix, "/")
+	}
+	return path.Dir(prefix)
+}
+
+// walkPackageDirs calls fn for each directory under root which may contain a
+// package. As with the go tool, testdata directories and directories beginning
+// with "." or "_" are skipped, as are vendor directories unless walkVendor is
+// set. If skipModules is set, directories containing other modules are
+// skipped.
+func walkPackageDirs(root string, walkVendor, skipModules bool, fn func(dir string)) error {
+	if !isDir(root) {
+		return nil
+	}
+	// filepath.Walk does not follow symlinks, so walk the real directory and
+	// report directories relative to root.
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(realRoot, func(dir string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if dir != realRoot {
+			name := info.Name()
+			if name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || (name == "vendor" && !walkVendor) {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); skipModules && err == nil {
+				return filepath.SkipDir
+			}
+		}
+		rel, err := filepath.Rel(realRoot, dir)
+		if err != nil {
+			return err
+		}
+		fn(filepath.Join(root, rel))
+		return nil
+	})
+}
+
+// hasPackage reports whether dir holds a package which can be built in the
+// context.
+func hasPackage(bctx build.Context, dir string) bool {
+	_, err := bctx.ImportDir(dir, 0)
+	_, noGo := err.(*build.NoGoError)
+	return !noGo
+}
+
+// expandLocal expands a local pattern relative to srcDir, returning local
+// paths relative to srcDir.
+func expandLocal(bctx build.Context, pattern, srcDir string, skipModules bool) ([]string, error) {
+	match := matchPattern(pattern)
+	root := filepath.Join(srcDir, filepath.FromSlash(patternRoot(pattern)))
+	var matches []string
+	err := walkPackageDirs(root, hasPathElement(pattern, "vendor"), skipModules, func(dir string) {
+		rel, err := filepath.Rel(srcDir, dir)
+		if err != nil {
+			return
+		}
+		local := filepath.ToSlash(rel)
+		if local != "." && local != ".." && !strings.HasPrefix(local, "../") {
+			local = "./" + local
+		}
+		if match(local) && hasPackage(bctx, dir) {
+			matches = append(matches, local)
+		}
+	})
+	return matches, err
+}
+
+// expandTree expands an import path pattern within the source tree in
+// treeDir, which holds the packages with import paths under treePath. If
+// treePath is empty, the import paths are relative to treeDir, as in GOPATH.
+func expandTree(bctx build.Context, pattern, treeDir, treePath string, skipModules bool) ([]string, error) {
+	// Only walk the part of the tree which may match the pattern.
+	root := patternRoot(pattern)
+	if root == "." {
+		root = ""
+	}
+	var startDir, startPath string
+	switch {
+	case treePath == "" || root == treePath || strings.HasPrefix(root, treePath+"/"):
+		startDir = filepath.Join(treeDir, filepath.FromSlash(strings.TrimPrefix(root, treePath)))
+		startPath = root
+	case root == "" || strings.HasPrefix(treePath, root+"/"):
+		startDir = treeDir
+		startPath = treePath
+	default:
+		return nil, nil
+	}
+
+	match := matchPattern(pattern)
+	var matches []string
+	err := walkPackageDirs(startDir, hasPathElement(pattern, "vendor"), skipModules, func(dir string) {
+		rel, err := filepath.Rel(startDir, dir)
+		if err != nil {
+			return
+		}
+		importPath := path.Join(startPath, filepath.ToSlash(rel))
+		if importPath != "." && match(importPath) && hasPackage(bctx, dir) {
+			matches = append(matches, importPath)
+		}
+	})
+	return matches, err
+}
+
+// Expand expands the pattern by walking GOROOT and GOPATH, or the directory
+// tree under srcDir for local patterns.
+func (l *BuildLoader) Expand(pattern, srcDir string) ([]string, error) {
+	if build.IsLocalImport(pattern) {
+		return expandLocal(l.Context, pattern, srcDir, false)
+	}
+	var matches []string
+	for _, root := range l.Context.SrcDirs() {
+		m, err := expandTree(l.Context, pattern, root, "", false)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// Expand expands the pattern by walking the modules in the build list and
+// GOROOT, or the directory tree under srcDir for local patterns. Nested
+// modules are not part of the tree they are nested in.
+func (l *ModuleLoader) Expand(pattern, srcDir string) ([]string, error) {
+	if build.IsLocalImport(pattern) {
+		return expandLocal(l.Context, pattern, srcDir, true)
+	}
+	matches, err := expandTree(l.Context, pattern, filepath.Join(l.Context.GOROOT, "src"), "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var modPaths []string
+	for modPath := range l.Modules.List {
+		modPaths = append(modPaths, modPath)
+	}
+	sort.Strings(modPaths)
+	for _, modPath := range modPaths {
+		m, err := expandTree(l.Context, pattern, l.Modules.List[modPath].Dir, modPath, true)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// Expand matches the pattern against the import paths, or for local patterns
+// the directories, of the known packages.
+func (l StaticLoader) Expand(pattern, srcDir string) ([]string, error) {
+	var matches []string
+	if build.IsLocalImport(pattern) {
+		match := matchPattern(filepath.ToSlash(filepath.Join(srcDir, pattern)))
+		for importPath, pkg := range l {
+			if match(filepath.ToSlash(pkg.Dir)) {
+				matches = append(matches, importPath)
+			}
+		}
+	} else {
+		match := matchPattern(pattern)
+		for importPath := range l {
+			if match(importPath) {
+				matches = append(matches, importPath)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
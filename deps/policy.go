@@ -0,0 +1,226 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// Policy is a set of rules restricting the dependencies between packages.
+// Policies are read from JSON files:
+//
+//	{
+//	  "rules": [
+//	    {
+//	      "name": "the API does not use storage",
+//	      "from": "^example.com/internal/api/",
+//	      "to": "^example.com/internal/storage/"
+//	    },
+//	    {
+//	      "name": "binaries do not import testing",
+//	      "from": "^example.com/cmd/",
+//	      "to": "^testing$",
+//	      "direct": true
+//	    }
+//	  ],
+//	  "layers": [
+//	    {"name": "domain", "packages": "^example.com/domain/"},
+//	    {"name": "service", "packages": "^example.com/service/"},
+//	    {"name": "cmd", "packages": "^example.com/cmd/"}
+//	  ]
+//	}
+type Policy struct {
+	Rules []*Rule `json:"rules"`
+	// The architecture layers, lowest first. Packages must not import
+	// packages in a higher layer.
+	Layers []*Layer `json:"layers,omitempty"`
+}
+
+// Layer is a group of packages in a layered architecture.
+type Layer struct {
+	Name string `json:"name"`
+	// A regular expression matching the packages in the layer. Packages
+	// matching several layers are in the first one.
+	Packages string `json:"packages"`
+
+	packages *regexp.Regexp
+}
+
+// Rule forbids packages matching From from depending on packages matching To.
+// Both are regular expressions, matched against full import paths.
+type Rule struct {
+	// A description of the rule, for reporting violations.
+	Name string `json:"name,omitempty"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Whether only direct imports are forbidden. By default, transitive
+	// dependencies are also forbidden.
+	Direct bool `json:"direct,omitempty"`
+
+	from, to *regexp.Regexp
+}
+
+// Violation is a dependency which breaks a rule or the layering.
+type Violation struct {
+	// The rule broken, or nil for imports of a higher layer.
+	Rule *Rule
+	// The import path from the package breaking the rule to the forbidden
+	// package.
+	Path Path
+	// For imports of a higher layer, the layers of the importing and imported
+	// packages.
+	FromLayer, ToLayer *Layer
+}
+
+// String describes the rule or layering broken.
+func (v Violation) String() string {
+	if v.Rule != nil {
+		return v.Rule.String()
+	}
+	return fmt.Sprintf("layer %s must not import layer %s", v.FromLayer.Name, v.ToLayer.Name)
+}
+
+// ReadPolicy reads a policy from JSON, and validates its rules.
+func ReadPolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid JSON policy: %v", err)
+	}
+	for i, rule := range p.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule %d: %v", i+1, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, layer := range p.Layers {
+		if err := layer.compile(); err != nil {
+			return nil, fmt.Errorf("invalid layer %d: %v", i+1, err)
+		}
+		if names[layer.Name] {
+			return nil, fmt.Errorf("invalid layer %d: duplicate name %q", i+1, layer.Name)
+		}
+		names[layer.Name] = true
+	}
+	return &p, nil
+}
+
+func (l *Layer) compile() error {
+	if l.Name == "" || l.Packages == "" {
+		return fmt.Errorf("name and packages must be set")
+	}
+	var err error
+	if l.packages, err = regexp.Compile(l.Packages); err != nil {
+		return fmt.Errorf("invalid packages: %v", err)
+	}
+	return nil
+}
+
+// LayerOf returns the index of the layer of the package, or -1 if it is not
+// in any layer.
+func (p *Policy) LayerOf(pkg Package) int {
+	for i, layer := range p.Layers {
+		if layer.packages == nil {
+			if err := layer.compile(); err != nil {
+				continue
+			}
+		}
+		if layer.packages.MatchString(string(pkg)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Rule) compile() error {
+	if r.From == "" || r.To == "" {
+		return fmt.Errorf("from and to must be set")
+	}
+	var err error
+	if r.from, err = regexp.Compile(r.From); err != nil {
+		return fmt.Errorf("invalid from: %v", err)
+	}
+	if r.to, err = regexp.Compile(r.To); err != nil {
+		return fmt.Errorf("invalid to: %v", err)
+	}
+	return nil
+}
+
+// String returns the name of the rule, or a description of it.
+func (r *Rule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if r.Direct {
+		return fmt.Sprintf("%s must not import %s", r.From, r.To)
+	}
+	return fmt.Sprintf("%s must not depend on %s", r.From, r.To)
+}
+
+// Check returns the violations of the policy in the graph. Each package
+// breaking a rule is reported once per rule, with a shortest path to a
+// forbidden package, or for direct rules once per forbidden import. Imports of
+// a higher layer are reported after the rules.
+func (p *Policy) Check(g Graph) ([]Violation, error) {
+	var violations []Violation
+	for _, rule := range p.Rules {
+		if rule.from == nil {
+			if err := rule.compile(); err != nil {
+				return nil, err
+			}
+		}
+		for _, pkg := range g.sortedPackages() {
+			if !rule.from.MatchString(string(pkg)) {
+				continue
+			}
+			if rule.Direct {
+				for _, imp := range g[pkg].Sorted() {
+					if rule.to.MatchString(string(imp)) {
+						violations = append(violations, Violation{Rule: rule, Path: Path{pkg, imp}})
+					}
+				}
+				continue
+			}
+			path := g.ShortestPathCond(pkg, func(dep Package) bool {
+				return dep != pkg && rule.to.MatchString(string(dep))
+			})
+			if path != nil {
+				violations = append(violations, Violation{Rule: rule, Path: path})
+			}
+		}
+	}
+
+	for _, layer := range p.Layers {
+		if layer.packages == nil {
+			if err := layer.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, pkg := range g.sortedPackages() {
+		from := p.LayerOf(pkg)
+		if from < 0 {
+			continue
+		}
+		for _, imp := range g[pkg].Sorted() {
+			if to := p.LayerOf(imp); to > from {
+				violations = append(violations, Violation{
+					Path:      Path{pkg, imp},
+					FromLayer: p.Layers[from],
+					ToLayer:   p.Layers[to],
+				})
+			}
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"fmt"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// SymbolUse is an exported symbol of an imported package, and where the
+// importing package uses it.
+type SymbolUse struct {
+	// The name of the symbol. Methods are qualified by their receiver type,
+	// such as "Client.Do".
+	Symbol string `json:"symbol"`
+	// The positions of the uses, sorted.
+	Uses []ImportPos `json:"uses"`
+}
+
+// SymbolLoader type checks packages with golang.org/x/tools/go/packages, to
+// find which symbols of their imports they use.
+type SymbolLoader struct {
+	// The configuration for loading packages. Mode and Tests are overridden.
+	Config packages.Config
+	// Whether to include uses in test files.
+	Tests bool
+}
+
+const symbolsLoadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports |
+	packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+
+// Load type checks the importing packages of the edges, and returns the
+// exported symbols each importing package uses from the imported package,
+// sorted by name. Imports which only exist for their side effects use no
+// symbols. Packages with type errors are reported on stderr, and only the
+// uses which could be resolved are returned for them.
+func (l *SymbolLoader) Load(edges []Edge) (map[Edge][]SymbolUse, error) {
+	wanted := make(map[Edge]bool, len(edges))
+	importers := NewSet()
+	for _, e := range edges {
+		wanted[e] = true
+		importers.Insert(e.From)
+	}
+	if len(importers) == 0 {
+		return nil, nil
+	}
+	cfg := l.Config
+	cfg.Mode = symbolsLoadMode
+	cfg.Tests = l.Tests
+	var patterns []string
+	for _, pkg := range importers.Sorted() {
+		patterns = append(patterns, string(pkg))
+	}
+	pkgs, err := packages.Load(&cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The positions of the uses of each symbol on each edge. With tests, a
+	// package is also type checked as part of its test variant, so the same
+	// use may be seen twice.
+	uses := make(map[Edge]map[string]map[ImportPos]bool)
+	reported := make(map[string]bool)
+	for _, p := range pkgs {
+		importer := Package(p.PkgPath)
+		if forTest, isTest := testVariantOf(p); isTest {
+			if forTest == "" {
+				// The generated test main.
+				continue
+			}
+			importer = Package(forTest)
+		}
+		// Type errors leave the uses partially recorded, which is still useful.
+		// The go command reports the same errors from compiling the package,
+		// so its errors are only fatal if no files were found.
+		for _, e := range p.Errors {
+			if e.Kind == packages.ListError {
+				if len(p.GoFiles) == 0 {
+					return nil, fmt.Errorf("unable to load %q: %v", importer, e)
+				}
+				continue
+			}
+			// Test variants repeat the errors of the package.
+			if msg := e.Error(); !reported[msg] {
+				reported[msg] = true
+				fmt.Fprintf(os.Stderr, "Warning: symbols used by %q may be missing: %v\n", importer, e)
+			}
+		}
+		if p.TypesInfo == nil {
+			continue
+		}
+		for ident, obj := range p.TypesInfo.Uses {
+			if obj.Pkg() == nil || !obj.Exported() {
+				continue
+			}
+			edge := Edge{importer, stripVendor(obj.Pkg().Path())}
+			if !wanted[edge] {
+				continue
+			}
+			pos := p.Fset.Position(ident.Pos())
+			file, err := filepath.Rel(p.Dir, pos.Filename)
+			if err != nil {
+				file = pos.Filename
+			}
+			symbol := symbolName(obj)
+			if uses[edge] == nil {
+				uses[edge] = make(map[string]map[ImportPos]bool)
+			}
+			if uses[edge][symbol] == nil {
+				uses[edge][symbol] = make(map[ImportPos]bool)
+			}
+			uses[edge][symbol][ImportPos{filepath.ToSlash(file), pos.Line}] = true
+		}
+	}
+
+	symbols := make(map[Edge][]SymbolUse, len(edges))
+	for _, e := range edges {
+		symbols[e] = []SymbolUse{}
+	}
+	for edge, bySymbol := range uses {
+		for symbol, positions := range bySymbol {
+			use := SymbolUse{Symbol: symbol}
+			for pos := range positions {
+				use.Uses = append(use.Uses, pos)
+			}
+			sort.Slice(use.Uses, func(i, j int) bool {
+				if use.Uses[i].File != use.Uses[j].File {
+					return use.Uses[i].File < use.Uses[j].File
+				}
+				return use.Uses[i].Line < use.Uses[j].Line
+			})
+			symbols[edge] = append(symbols[edge], use)
+		}
+		sort.Slice(symbols[edge], func(i, j int) bool {
+			return symbols[edge][i].Symbol < symbols[edge][j].Symbol
+		})
+	}
+	return symbols, nil
+}
+
+// symbolName returns the name of the object, qualified by the receiver type
+// for methods.
+func symbolName(obj types.Object) string {
+	if f, ok := obj.(*types.Func); ok {
+		if recv := f.Type().(*types.Signature).Recv(); recv != nil {
+			t := recv.Type()
+			if p, ok := t.(*types.Pointer); ok {
+				t = p.Elem()
+			}
+			if named, ok := t.(*types.Named); ok {
+				return named.Obj().Name() + "." + obj.Name()
+			}
+		}
+	}
+	return obj.Name()
+}
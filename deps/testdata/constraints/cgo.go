@@ -0,0 +1,6 @@
+package p
+
+// int x;
+import "C"
+
+import _ "example.com/s"
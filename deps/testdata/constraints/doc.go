@@ -0,0 +1,4 @@
+//go:build darwin
+package p
+
+import _ "example.com/u"
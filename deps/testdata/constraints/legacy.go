@@ -0,0 +1,6 @@
+// +build bar baz
+// +build !qux
+
+package p
+
+import _ "example.com/t"
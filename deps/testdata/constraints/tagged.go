@@ -0,0 +1,11 @@
+// Copyright comments do not affect the constraint.
+
+//go:build foo && !cgo
+// +build foo,!cgo
+
+package p
+
+import (
+	_ "example.com/q"
+	_ "example.com/s"
+)
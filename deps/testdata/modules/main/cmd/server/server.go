@@ -0,0 +1,6 @@
+package main
+
+import (
+	_ "example.com/main"
+	_ "example.com/util/strs"
+)
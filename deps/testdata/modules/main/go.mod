@@ -0,0 +1,12 @@
+module example.com/main
+
+go 1.16
+
+require (
+	example.com/lib v1.0.0
+	example.com/util v1.1.0
+)
+
+replace example.com/lib => ../lib
+
+exclude example.com/util v1.1.0
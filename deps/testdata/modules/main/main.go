@@ -0,0 +1,7 @@
+package main
+
+import (
+	_ "errors"
+
+	_ "example.com/lib"
+)
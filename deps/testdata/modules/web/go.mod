@@ -0,0 +1,5 @@
+module example.com/web
+
+go 1.16
+
+require golang.org/x/net v0.56.0
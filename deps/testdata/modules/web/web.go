@@ -0,0 +1,7 @@
+package web
+
+import (
+	_ "net/http"
+
+	_ "golang.org/x/net/http/httpguts"
+)
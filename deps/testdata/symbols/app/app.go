@@ -0,0 +1,11 @@
+package app
+
+import (
+	"example.com/symbols/lib"
+	_ "example.com/symbols/side"
+)
+
+func Run() {
+	var c *lib.Client = lib.New()
+	c.Do()
+}
@@ -0,0 +1,11 @@
+package app
+
+import (
+	"testing"
+
+	"example.com/symbols/testlib"
+)
+
+func TestRun(t *testing.T) {
+	testlib.Helper()
+}
@@ -0,0 +1,9 @@
+package broken
+
+import "example.com/symbols/lib"
+
+var n int = "not an int"
+
+func Run() {
+	lib.New()
+}
@@ -0,0 +1,9 @@
+package lib
+
+type Client struct{}
+
+func New() *Client {
+	return &Client{}
+}
+
+func (c *Client) Do() {}
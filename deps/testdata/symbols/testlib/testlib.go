@@ -0,0 +1,3 @@
+package testlib
+
+func Helper() {}
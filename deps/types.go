@@ -8,6 +8,11 @@ https://opensource.org/licenses/MIT.
 
 package deps
 
+import (
+	"encoding/json"
+	"sort"
+)
+
 // Package is the full import path of a Go package.
 type Package string
 
@@ -23,6 +28,12 @@ func (p Path) Pop() Path {
 	return p[:len(p)-1]
 }
 
+// Edge is an import of one package by another.
+type Edge struct {
+	From Package `json:"from"`
+	To   Package `json:"to"`
+}
+
 type present struct{}
 
 type Set map[Package]present
@@ -47,3 +58,27 @@ func (ps Set) Has(pkg Package) bool {
 	_, found := ps[pkg]
 	return found
 }
+
+// Sorted returns the packages in the set in sorted order.
+func (ps Set) Sorted() []Package {
+	pkgs := make([]Package, 0, len(ps))
+	for pkg := range ps {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i] < pkgs[j] })
+	return pkgs
+}
+
+// MarshalJSON encodes the set as a sorted list of packages.
+func (ps Set) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ps.Sorted())
+}
+
+func (ps *Set) UnmarshalJSON(data []byte) error {
+	var pkgs []Package
+	if err := json.Unmarshal(data, &pkgs); err != nil {
+		return err
+	}
+	*ps = NewSet(pkgs...)
+	return nil
+}
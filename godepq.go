@@ -9,32 +9,95 @@ https://opensource.org/licenses/MIT.
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"go/build"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/google/godepq/deps"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
-	// TODO: add support for multiple from / to packages
-	from            = flag.String("from", "", "root package")
-	to              = flag.String("to", "", "target package for querying dependency paths")
+	from            listFlag
+	to              listFlag
 	toRegex         = flag.String("toregex", "", "target package regex for querying dependency paths")
+	rdeps           = flag.String("rdeps", "", "target package for querying reverse dependencies (packages which depend on it)")
+	cycles          = flag.Bool("cycles", false, "report import cycles, exiting with a non-zero status if any are found")
+	dominators      = flag.Bool("dominators", false, "list the immediate dominator of each package, and the lines of code it dominates")
+	depth           = flag.Int("depth", 0, "maximum depth of -rdeps results (0 for unlimited)")
 	ignore          = flag.String("ignore", "", "regular expression for packages to ignore")
 	include         = flag.String("include", "", "regular expression for packages to include (excluding packages matching -ignore)")
 	includeTests    = flag.Bool("include-tests", false, "whether to include test imports")
+	rootTests       = flag.Bool("root-tests", false, "with -include-tests, include only the tests of the -from packages, following production imports beyond them")
 	includeStdlib   = flag.Bool("include-stdlib", false, "whether to include go standard library imports")
 	allPaths        = flag.Bool("all-paths", false, "whether to include all paths in the result")
-	output          = flag.String("o", "list", "{list: print path(s), dot: export dot graph}")
+	shortest        = flag.Bool("shortest", false, "whether to find a shortest path, breaking ties by package name")
+	unordered       = flag.Bool("unordered", false, "whether to skip sorting list and dot output, which is faster for large graphs but differs between runs")
+	kPaths          = flag.Int("k", 0, "find the k shortest paths, and print them separately")
+	cut             = flag.Bool("cut", false, "find a smallest set of imports which, if removed, would leave no path to the -to packages")
+	output          = flag.String("o", "list", "{list: print path(s), dot: export dot graph, json: print JSON}")
 	showLinesOfCode = flag.Bool("show-loc", false, "show lines of code per package")
+	showImports     = flag.Bool("show-imports", false, "list the imports between packages, with the positions of the import statements")
+	whySymbols      = flag.Bool("why-symbols", false, "for path queries, type check the importing packages and list the symbols used from each import")
+	goos            = flag.String("goos", "", "target operating system (default the host's)")
+	goarch          = flag.String("goarch", "", "target architecture (default the host's)")
+	tags            = flag.String("tags", "", "comma separated build tags")
+	matrix          = flag.String("matrix", "", "space separated goos/goarch platforms, each optionally followed by comma separated build tags; reports the packages and imports specific to some platforms")
+	cacheDir        = flag.String("cache-dir", "", "directory for caching the data read from each package between runs, for the build loader")
+	jobs            = flag.Int("j", 0, "number of packages to load concurrently (0 for the number of CPUs)")
+	loaderName      = flag.String("loader", "build", "{build: go/build, modules aware; packages: golang.org/x/tools/go/packages; golist: go list -json}")
+	packagesJSON    = flag.String("packages-json", "", "read package data from a file of `go list -json` output instead of loading it (- for stdin)")
+	oldGraph        = flag.String("old", "", "directory or JSON graph (from -o json) to compare from, for the diff command")
+	newGraph        = flag.String("new", "", "directory or JSON graph to compare to, for the diff command (default the working directory)")
+	oldGOPATH       = flag.String("old-gopath", "", "GOPATH for building the -old directory, for the diff command")
+	newGOPATH       = flag.String("new-gopath", "", "GOPATH for building the -new directory, for the diff command")
+	revOld          = flag.String("rev-old", "", "git revision to compare from, building it in a temporary worktree; implies diff")
+	revNew          = flag.String("rev-new", "", "git revision to compare to (default the working directory)")
+	baseline        = flag.String("baseline", "", "baseline file of allowed dependencies; fails if packages outside of it are added")
+	updateBaseline  = flag.Bool("update-baseline", false, "whether to write the current dependencies to the -baseline file")
+	baselineEdges   = flag.Bool("baseline-edges", false, "whether -update-baseline also records imports, so that new imports fail (kept when updating a baseline which records them)")
+	rules           = flag.String("rules", "", "JSON policy file of dependency rules, for the check command")
+
+	// The subcommand, if any.
+	command string
 )
 
+func init() {
+	flag.Var(&from, "from", "root package(s), repeated or comma separated; patterns such as ./... or github.com/org/repo/... are expanded")
+	flag.Var(&to, "to", "target package(s) for querying dependency paths, repeated or comma separated")
+}
+
+// listFlag is a flag which can be repeated, and accepts comma separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Usage: godepq [check|diff] [flags]
 func main() {
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "check" || args[0] == "diff") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	err := run()
 	if err != nil {
@@ -54,30 +117,1026 @@ func run() error {
 		return err
 	}
 
-	fromPkg, baseDir, err := resolveSource(*from, wd)
+	if command == "diff" {
+		ok, err := runDiff(wd)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	if *matrix != "" {
+		return runMatrix(wd)
+	}
+
+	graph, loader, err := buildGraph(wd, "", flagPlatform())
 	if err != nil {
 		return err
 	}
-	var toPkg deps.Package
-	if *to != "" {
-		toPkg, err = deps.Resolve(*to, wd, build.Default)
+	fromPkgs := graph.Roots
+	var targets []target
+	for _, t := range to {
+		toPkg, err := resolve(t, wd, loader)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target{string(toPkg), func(pkg deps.Package) bool {
+			return pkg == toPkg
+		}})
+	}
+	if *toRegex != "" {
+		r := regexp.MustCompile(*toRegex)
+		targets = append(targets, target{*toRegex, func(pkg deps.Package) bool {
+			return r.MatchString(string(pkg))
+		}})
+	}
+	var rdepsPkg deps.Package
+	if *rdeps != "" {
+		rdepsPkg, err = resolve(*rdeps, wd, loader)
+		if err != nil {
+			return err
+		}
+	}
+
+	if command == "check" {
+		ok, err := runCheck(graph)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	if *baseline != "" {
+		ok, err := runBaseline(graph)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	if *cycles {
+		if !printCycles(graph) {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	if *dominators {
+		printDominators(graph)
+		return nil
+	}
+
+	if rdepsPkg != "" {
+		// Packages are listed starting at the target, so edges point from a package to its
+		// importers.
+		result := graph.Reverse.Reachable(rdepsPkg, *depth)
+		if len(result) == 0 {
+			fmt.Fprintf(os.Stderr, "No packages under %v depend on %q\n", fromPkgs, rdepsPkg)
+			os.Exit(1)
+		}
+		if *output == "json" {
+			// JSON edges always point from importer to imported.
+			forward := deps.NewGraph()
+			for pkg, importers := range result {
+				forward.Pkg(pkg)
+				for importer := range importers {
+					forward.Pkg(importer).Insert(pkg)
+				}
+			}
+			printResult(graph, []deps.Package{rdepsPkg}, forward, nil)
+			return nil
+		}
+		// The imports keep the positions of their import statements.
+		reversed := graph
+		reversed.EdgeInfo = make(map[deps.Edge]*deps.EdgeInfo, len(graph.EdgeInfo))
+		for e, info := range graph.EdgeInfo {
+			reversed.EdgeInfo[deps.Edge{From: e.To, To: e.From}] = info
+		}
+		printResult(reversed, []deps.Package{rdepsPkg}, result, nil)
+		return nil
+	}
+
+	if len(targets) == 0 {
+		printResult(graph, fromPkgs, graph.Forward, nil)
+		return nil
+	}
+
+	if *cut {
+		if !printCuts(graph, fromPkgs, targets) {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	type pathResult struct {
+		from   deps.Package
+		to     string
+		result deps.Graph
+		// The paths found, unless all paths were requested.
+		paths []deps.Path
+	}
+	var results []pathResult
+	for _, fromPkg := range fromPkgs {
+		for _, t := range targets {
+			var result deps.Graph
+			var paths []deps.Path
+			switch {
+			case *allPaths:
+				result = graph.Forward.AllPathsCond(fromPkg, t.cond)
+			case *kPaths > 0:
+				paths = graph.Forward.KShortestPathsCond(fromPkg, t.cond, *kPaths)
+			case *shortest:
+				if path := graph.Forward.ShortestPathCond(fromPkg, t.cond); path != nil {
+					paths = []deps.Path{path}
+				}
+			default:
+				if path := graph.Forward.SomePathCond(fromPkg, t.cond); path != nil {
+					paths = []deps.Path{path}
+				}
+			}
+			if result == nil {
+				result = deps.NewGraph()
+				for _, path := range paths {
+					result.AddPath(path)
+				}
+			}
+			if len(result) == 0 {
+				fmt.Fprintf(os.Stderr, "No path found from %q to %q\n", fromPkg, t.name)
+				continue
+			}
+			results = append(results, pathResult{fromPkg, t.name, result, paths})
+		}
+	}
+	if len(results) == 0 {
+		os.Exit(1)
+	}
+	if *whySymbols {
+		union := deps.NewGraph()
+		for _, r := range results {
+			for pkg, imports := range r.result {
+				for imp := range imports {
+					union.Pkg(pkg).Insert(imp)
+				}
+			}
+		}
+		if err := loadSymbols(graph, wd, union); err != nil {
+			return err
+		}
+	}
+
+	if *output == "json" {
+		// A single document holds the union of the results, and each path found.
+		union := deps.NewGraph()
+		var paths []deps.JSONPath
+		for _, r := range results {
+			for pkg, edges := range r.result {
+				for edge := range edges {
+					union.Pkg(pkg).Insert(edge)
+				}
+				union.Pkg(pkg)
+			}
+			for _, path := range r.paths {
+				paths = append(paths, deps.JSONPath{From: r.from, To: r.to, Path: path})
+			}
+		}
+		printResult(graph, fromPkgs, union, paths)
+		return nil
+	}
+	if len(fromPkgs) == 1 && len(targets) == 1 {
+		printPathResult(graph, fromPkgs, results[0].result, results[0].paths)
+		return nil
+	}
+	// Group the results by root and target.
+	for i, r := range results {
+		switch *output {
+		case "list":
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("From %q to %q:\n", r.from, r.to)
+		case "dot":
+			fmt.Printf("// From %q to %q\n", r.from, r.to)
+		}
+		printPathResult(graph, []deps.Package{r.from}, r.result, r.paths)
+	}
+	return nil
+}
+
+// runMatrix builds the graph for each platform of the -matrix, and prints the packages and imports
+// which are only in some of them.
+func runMatrix(wd string) error {
+	base := flagPlatform()
+	var names []string
+	var graphs []deps.Dependencies
+	for _, entry := range strings.Fields(*matrix) {
+		platform, err := deps.ParsePlatform(entry)
 		if err != nil {
 			return err
 		}
+		platform.Tags = append(append([]string{}, base.Tags...), platform.Tags...)
+		graph, _, err := buildGraph(wd, "", platform)
+		if err != nil {
+			return fmt.Errorf("%s: %v", platform, err)
+		}
+		names = append(names, platform.String())
+		graphs = append(graphs, graph)
+	}
+	printMatrix(deps.NewMatrix(names, graphs), graphs)
+	return nil
+}
+
+// printMatrix prints the packages and imports which are only in the graphs of some platforms.
+func printMatrix(m *deps.Matrix, graphs []deps.Dependencies) {
+	pkgs, edges := m.Specific()
+	switch *output {
+	case "list":
+		fmt.Printf("Platforms: %s\n", strings.Join(m.Names, ", "))
+		if len(pkgs) == 0 && len(edges) == 0 {
+			fmt.Println("No platform-specific packages or imports found")
+			return
+		}
+		if len(pkgs) != 0 {
+			fmt.Printf("Platform-specific packages (%d):\n", len(pkgs))
+			for _, pkg := range pkgs {
+				fmt.Printf("  %s: %s\n", pkg, strings.Join(m.In(m.Packages[pkg]), ", "))
+			}
+		}
+		if len(edges) != 0 {
+			fmt.Printf("Platform-specific imports (%d):\n", len(edges))
+			for _, e := range edges {
+				fmt.Printf("  %s -> %s: %s\n", e.From, e.To, strings.Join(m.In(m.Edges[e]), ", "))
+			}
+		}
+	case "dot":
+		// Render the union of the graphs, with platform-specific packages in blue and imports
+		// dashed.
+		specific := deps.NewSet(pkgs...)
+		roots := deps.NewSet()
+		for _, graph := range graphs {
+			for _, root := range graph.Roots {
+				roots.Insert(root)
+			}
+		}
+		fmt.Println(m.Graph().DotStyled(roots.Sorted(), deps.DotStyle{
+			Label: func(pkg deps.Package) string {
+				if specific.Has(pkg) {
+					return fmt.Sprintf("%s\\n%s", pkg, strings.Join(m.In(m.Packages[pkg]), ", "))
+				}
+				return string(pkg)
+			},
+			NodeAttrs: func(pkg deps.Package) string {
+				if specific.Has(pkg) {
+					return `color="blue"`
+				}
+				return ""
+			},
+			EdgeAttrs: func(from, to deps.Package) string {
+				if in := m.Edges[deps.Edge{From: from, To: to}]; len(in) < len(m.Names) {
+					return fmt.Sprintf("style=\"dashed\",tooltip=%q", strings.Join(m.In(in), ", "))
+				}
+				return ""
+			},
+			Unordered: *unordered,
+		}))
+	case "json":
+		type matrixPackage struct {
+			Package   deps.Package `json:"package"`
+			Platforms []string     `json:"platforms"`
+		}
+		type matrixEdge struct {
+			From      deps.Package `json:"from"`
+			To        deps.Package `json:"to"`
+			Platforms []string     `json:"platforms"`
+		}
+		result := struct {
+			Platforms []string        `json:"platforms"`
+			Packages  []matrixPackage `json:"packages"`
+			Edges     []matrixEdge    `json:"edges"`
+		}{m.Names, []matrixPackage{}, []matrixEdge{}}
+		for _, pkg := range pkgs {
+			result.Packages = append(result.Packages, matrixPackage{pkg, m.In(m.Packages[pkg])})
+		}
+		for _, e := range edges {
+			result.Edges = append(result.Edges, matrixEdge{e.From, e.To, m.In(m.Edges[e])})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runDiff compares the old and new graphs, prints the differences and reports whether there were
+// none.
+func runDiff(wd string) (bool, error) {
+	oldDeps, err := loadSide(wd, *oldGraph, *oldGOPATH, *revOld)
+	if err != nil {
+		return false, fmt.Errorf("old: %v", err)
+	}
+	newDeps, err := loadSide(wd, *newGraph, *newGOPATH, *revNew)
+	if err != nil {
+		return false, fmt.Errorf("new: %v", err)
+	}
+	diff := deps.Diff(oldDeps, newDeps)
+	printDiff(diff, oldDeps, newDeps)
+	return diff.Empty(), nil
+}
+
+// loadSide loads one side of a diff: the graph of a git revision if rev is set, or else of the
+// source directory or JSON graph, which defaults to the working directory.
+func loadSide(wd, source, gopath, rev string) (deps.Dependencies, error) {
+	if rev == "" {
+		if source == "" {
+			source = wd
+		}
+		return loadGraph(source, gopath)
+	}
+	tree, err := checkoutRevision(wd, rev)
+	if err != nil {
+		return deps.Dependencies{}, err
+	}
+	defer tree.remove()
+	graph, _, err := buildGraph(tree.dir, tree.gopath, flagPlatform())
+	return graph, err
+}
+
+// loadGraph reads a graph printed with -o json, or builds the graph of the -from packages in a
+// directory.
+func loadGraph(source, gopath string) (deps.Dependencies, error) {
+	if isFile(source) {
+		f, err := os.Open(source)
+		if err != nil {
+			return deps.Dependencies{}, err
+		}
+		defer f.Close()
+		var graph deps.Dependencies
+		if err := json.NewDecoder(f).Decode(&graph); err != nil {
+			return deps.Dependencies{}, fmt.Errorf("%s: %v", source, err)
+		}
+		return graph, nil
+	}
+	dir, err := filepath.Abs(source)
+	if err != nil {
+		return deps.Dependencies{}, err
+	}
+	graph, _, err := buildGraph(dir, gopath, flagPlatform())
+	return graph, err
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func printDiff(diff *deps.GraphDiff, oldDeps, newDeps deps.Dependencies) {
+	switch *output {
+	case "list":
+		if diff.Empty() {
+			fmt.Println("No differences found")
+			return
+		}
+		printPackages := func(title string, pkgs []deps.Package, info map[deps.Package]*deps.DependencyInfo) {
+			if len(pkgs) == 0 {
+				return
+			}
+			fmt.Printf("%s (%d):\n", title, len(pkgs))
+			for _, pkg := range pkgs {
+				if i, ok := info[pkg]; ok && *showLinesOfCode {
+					fmt.Printf("  %s (%d)\n", pkg, i.LOC)
+				} else {
+					fmt.Printf("  %s\n", pkg)
+				}
+			}
+		}
+		printEdges := func(title string, edges []deps.Edge) {
+			if len(edges) == 0 {
+				return
+			}
+			fmt.Printf("%s (%d):\n", title, len(edges))
+			for _, e := range edges {
+				fmt.Printf("  %s -> %s\n", e.From, e.To)
+			}
+		}
+		printPackages("Added packages", diff.AddedPackages, newDeps.Info)
+		printPackages("Removed packages", diff.RemovedPackages, oldDeps.Info)
+		printEdges("Added imports", diff.AddedEdges)
+		printEdges("Removed imports", diff.RemovedEdges)
+		if len(diff.LOCChanges) != 0 {
+			fmt.Println("Lines of code:")
+			for _, c := range diff.LOCChanges {
+				fmt.Printf("  %s: %d -> %d (%+d), transitive %d -> %d (%+d)\n", c.Package,
+					c.OldLOC, c.NewLOC, c.NewLOC-c.OldLOC,
+					c.OldTransitiveLOC, c.NewTransitiveLOC, c.NewTransitiveLOC-c.OldTransitiveLOC)
+			}
+		}
+	case "dot":
+		// Render the changed imports, with additions in green and removals in red.
+		added := deps.NewSet(diff.AddedPackages...)
+		removed := deps.NewSet(diff.RemovedPackages...)
+		result := diff.Graph()
+		style := deps.DotStyle{
+			Label: dotLabelFn(nil),
+			NodeAttrs: func(pkg deps.Package) string {
+				switch {
+				case added.Has(pkg):
+					return `color="green"`
+				case removed.Has(pkg):
+					return `color="red"`
+				}
+				return ""
+			},
+			EdgeAttrs: func(from, to deps.Package) string {
+				if newDeps.Forward[from].Has(to) {
+					return `color="green"`
+				}
+				return `color="red"`
+			},
+			Unordered: *unordered,
+		}
+		roots := deps.NewSet()
+		for pkg := range result {
+			roots.Insert(pkg)
+		}
+		fmt.Println(result.DotStyled(roots.Sorted(), style))
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diff); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runBaseline writes the graph to the -baseline file with -update-baseline, or else compares the
+// graph with the baseline. It reports whether the graph is within the baseline.
+func runBaseline(graph deps.Dependencies) (bool, error) {
+	if *updateBaseline {
+		withEdges := *baselineEdges
+		if old, err := readBaseline(*baseline); err == nil && old.Edges != nil {
+			// A baseline which records edges keeps them.
+			withEdges = true
+		}
+		f, err := os.Create(*baseline)
+		if err != nil {
+			return false, err
+		}
+		if err := deps.NewBaseline(graph, withEdges).Write(f); err != nil {
+			f.Close()
+			return false, err
+		}
+		if err := f.Close(); err != nil {
+			return false, err
+		}
+		fmt.Printf("Wrote %d packages to %s\n", len(graph.Forward), *baseline)
+		return true, nil
+	}
+
+	b, err := readBaseline(*baseline)
+	if os.IsNotExist(err) {
+		return false, fmt.Errorf("%s does not exist; create it with -update-baseline", *baseline)
+	} else if err != nil {
+		return false, err
+	}
+	if fmt.Sprint(deps.NewSet(b.Roots...).Sorted()) != fmt.Sprint(deps.NewSet(graph.Roots...).Sorted()) {
+		fmt.Fprintf(os.Stderr, "Warning: the roots %v differ from the roots of %s, %v\n", graph.Roots, *baseline, b.Roots)
+	}
+	diff := b.Check(graph)
+
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diff); err != nil {
+			return false, err
+		}
+	default:
+		if !diff.Grown() {
+			fmt.Printf("Dependencies are within %s\n", *baseline)
+		}
+		if len(diff.AddedPackages) != 0 {
+			fmt.Printf("Packages not in %s (%d):\n", *baseline, len(diff.AddedPackages))
+			for _, pkg := range diff.AddedPackages {
+				// Show how the package is reached.
+				var path deps.Path
+				for _, root := range graph.Roots {
+					if p := graph.Forward.ShortestPath(root, pkg); p != nil && (path == nil || len(p) < len(path)) {
+						path = p
+					}
+				}
+				fmt.Printf("  %s\n", pkg)
+				if len(path) > 1 {
+					fmt.Printf("    via %s\n", path[len(path)-2])
+				}
+			}
+		}
+		if len(diff.AddedEdges) != 0 {
+			fmt.Printf("Imports not in %s (%d):\n", *baseline, len(diff.AddedEdges))
+			for _, e := range diff.AddedEdges {
+				fmt.Printf("  %s -> %s\n", e.From, e.To)
+			}
+		}
+		if len(diff.RemovedPackages) != 0 || len(diff.RemovedEdges) != 0 {
+			fmt.Fprintf(os.Stderr, "%d packages and %d imports were removed since the baseline; run with -update-baseline to lower it\n",
+				len(diff.RemovedPackages), len(diff.RemovedEdges))
+		}
+	}
+	return !diff.Grown(), nil
+}
+
+// readBaseline reads the baseline file.
+func readBaseline(file string) (*deps.Baseline, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := deps.ReadBaseline(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return b, nil
+}
+
+// runCheck checks the graph against the -rules policy, prints the violations and reports whether
+// there were none.
+func runCheck(graph deps.Dependencies) (bool, error) {
+	f, err := os.Open(*rules)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	policy, err := deps.ReadPolicy(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", *rules, err)
+	}
+	violations, err := policy.Check(graph.Forward)
+	if err != nil {
+		return false, err
+	}
+
+	switch *output {
+	case "list":
+		if len(violations) == 0 {
+			fmt.Println("No violations found")
+		}
+		for i, v := range violations {
+			if i > 0 {
+				fmt.Println()
+			}
+			verb := "imports"
+			if v.Rule != nil && !v.Rule.Direct {
+				verb = "depends on"
+			}
+			fmt.Printf("Violation of %q: %s %s %s\n", v, v.Path[0], verb, v.Path.Last())
+			for _, pkg := range v.Path {
+				fmt.Printf("  %s\n", pkg)
+			}
+		}
+	case "dot":
+		// Render the union of the witness paths, or with layers the whole graph, with the import
+		// of each forbidden package in red.
+		result := deps.NewGraph()
+		var roots []deps.Package
+		offending := deps.NewGraph()
+		for _, v := range violations {
+			result.AddPath(v.Path)
+			roots = append(roots, v.Path[0])
+			offending.AddPath(v.Path[len(v.Path)-2:])
+		}
+		if len(policy.Layers) > 0 {
+			result, roots = graph.Forward, graph.Roots
+		}
+		style := deps.DotStyle{
+			Label: dotLabelFn(nil),
+			Cluster: func(pkg deps.Package) string {
+				if i := policy.LayerOf(pkg); i >= 0 {
+					return policy.Layers[i].Name
+				}
+				return ""
+			},
+			EdgeAttrs: func(from, to deps.Package) string {
+				if offending[from].Has(to) {
+					return `color="red"`
+				}
+				return ""
+			},
+			Unordered: *unordered,
+		}
+		if *showLinesOfCode {
+			style.Label = dotLabelFn(graph.Info)
+		}
+		fmt.Println(result.DotStyled(roots, style))
+	case "json":
+		type violation struct {
+			Rule string    `json:"rule"`
+			Path deps.Path `json:"path"`
+		}
+		result := struct {
+			Violations []violation `json:"violations"`
+		}{[]violation{}}
+		for _, v := range violations {
+			result.Violations = append(result.Violations, violation{v.String(), v.Path})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return false, err
+		}
+	}
+	return len(violations) == 0, nil
+}
+
+// printCycles prints the import cycles in the graph, and reports whether there were none.
+func printCycles(graph deps.Dependencies) bool {
+	var components [][]deps.Package
+	for _, component := range graph.Forward.StronglyConnectedComponents() {
+		// Components in a cycle, in the same order as the cycles.
+		if len(component) > 1 || graph.Forward[component[0]].Has(component[0]) {
+			components = append(components, component)
+		}
+	}
+	cyclePaths := graph.Forward.Cycles()
+
+	switch *output {
+	case "list":
+		if len(components) == 0 {
+			fmt.Println("No import cycles found")
+		}
+		for i, component := range components {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Cycle %d (%d packages):\n", i+1, len(component))
+			for _, pkg := range component {
+				fmt.Printf("  %s\n", pkg)
+			}
+			fmt.Println("Path:")
+			for _, pkg := range cyclePaths[i] {
+				fmt.Printf("  %s\n", pkg)
+			}
+		}
+	case "dot":
+		// Render the import cycles, starting each at its first package.
+		result := deps.NewGraph()
+		var roots []deps.Package
+		for _, component := range components {
+			members := deps.NewSet(component...)
+			for _, pkg := range component {
+				for edge := range graph.Forward[pkg] {
+					if members.Has(edge) {
+						result.Pkg(pkg).Insert(edge)
+					}
+				}
+			}
+			roots = append(roots, component[0])
+		}
+		printResult(graph, roots, result, nil)
+	case "json":
+		type cycle struct {
+			Packages []deps.Package `json:"packages"`
+			Path     deps.Path      `json:"path"`
+		}
+		result := struct {
+			Cycles []cycle `json:"cycles"`
+		}{[]cycle{}}
+		for i, component := range components {
+			result.Cycles = append(result.Cycles, cycle{component, cyclePaths[i]})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	return len(components) == 0
+}
+
+// cutResult is a minimum cut between a root and a target.
+type cutResult struct {
+	From  deps.Package `json:"from"`
+	To    deps.Package `json:"to"`
+	Edges []cutEdge    `json:"edges"`
+}
+
+// cutEdge is an import in a cut, with the positions of the import statements.
+type cutEdge struct {
+	From      deps.Package     `json:"from"`
+	To        deps.Package     `json:"to"`
+	Positions []deps.ImportPos `json:"positions"`
+}
+
+// printCuts prints a minimum cut between each root and target, and reports whether any paths were
+// found.
+func printCuts(graph deps.Dependencies, fromPkgs []deps.Package, targets []target) bool {
+	var results []cutResult
+	for _, fromPkg := range fromPkgs {
+		for _, t := range targets {
+			toPkg := deps.Package(t.name)
+			edges := graph.Forward.MinCut(fromPkg, toPkg)
+			if len(edges) == 0 {
+				fmt.Fprintf(os.Stderr, "No path found from %q to %q\n", fromPkg, toPkg)
+				continue
+			}
+			r := cutResult{From: fromPkg, To: toPkg}
+			for _, edge := range edges {
+				e := cutEdge{edge.From, edge.To, []deps.ImportPos{}}
+				if info, ok := graph.EdgeInfo[edge]; ok {
+					e.Positions = info.Positions
+				}
+				r.Edges = append(r.Edges, e)
+			}
+			results = append(results, r)
+		}
+	}
+	if len(results) == 0 {
+		return false
+	}
+
+	switch *output {
+	case "list":
+		for i, r := range results {
+			if i > 0 {
+				fmt.Println()
+			}
+			if len(results) > 1 {
+				fmt.Printf("From %q to %q:\n", r.From, r.To)
+			}
+			fmt.Printf("Cut (%d imports):\n", len(r.Edges))
+			for _, e := range r.Edges {
+				printImport(graph, e.From, e.To)
+			}
+		}
+	case "dot":
+		// Render all paths to the targets, with the imports in the cut in red.
+		result := deps.NewGraph()
+		cutEdges := deps.NewGraph()
+		var roots []deps.Package
+		for _, r := range results {
+			for pkg, imports := range graph.Forward.AllPaths(r.From, r.To) {
+				for imp := range imports {
+					result.Pkg(pkg).Insert(imp)
+				}
+				result.Pkg(pkg)
+			}
+			for _, e := range r.Edges {
+				cutEdges.Pkg(e.From).Insert(e.To)
+			}
+			roots = append(roots, r.From)
+		}
+		var info map[deps.Package]*deps.DependencyInfo
+		if *showLinesOfCode {
+			info = graph.Info
+		}
+		tooltip := dotEdgeAttrsFn(graph.EdgeInfo, *showLinesOfCode)
+		fmt.Println(result.DotStyled(roots, deps.DotStyle{
+			Label: dotLabelFn(info),
+			EdgeAttrs: func(from, to deps.Package) string {
+				attrs := tooltip(from, to)
+				if cutEdges[from].Has(to) {
+					if attrs != "" {
+						attrs += ","
+					}
+					attrs += `color="red"`
+				}
+				return attrs
+			},
+			Unordered: *unordered,
+		}))
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Cuts []cutResult `json:"cuts"`
+		}{results}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	return true
+}
+
+// printDominators prints the dominator tree of the graph. In list output, packages are sorted by the
+// lines of code they dominate, which would be removed by cutting the imports of the package.
+func printDominators(graph deps.Dependencies) {
+	idom := graph.Forward.Dominators(graph.Roots...)
+	// The number of packages each package dominates, including itself.
+	dominated := make(map[deps.Package]int, len(idom))
+	for pkg := range idom {
+		for dom := pkg; dom != deps.NullPackage; dom = idom[dom] {
+			dominated[dom]++
+		}
+	}
+	pkgs := make([]deps.Package, 0, len(idom))
+	for pkg := range idom {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		a, b := graph.Info[pkgs[i]].ExclusiveLOC, graph.Info[pkgs[j]].ExclusiveLOC
+		if a != b {
+			return a > b
+		}
+		return pkgs[i] < pkgs[j]
+	})
+
+	switch *output {
+	case "list":
+		fmt.Println("Dominators:")
+		for _, pkg := range pkgs {
+			dom := "none"
+			if idom[pkg] != deps.NullPackage {
+				dom = string(idom[pkg])
+			}
+			fmt.Printf("  %s (dominates %d LOC in %d packages), immediate dominator %s\n",
+				pkg, graph.Info[pkg].ExclusiveLOC, dominated[pkg], dom)
+		}
+	case "dot":
+		var roots []deps.Package
+		for _, pkg := range pkgs {
+			if idom[pkg] == deps.NullPackage {
+				roots = append(roots, pkg)
+			}
+		}
+		fmt.Println(graph.Forward.DominatorTree(graph.Roots...).DotStyled(roots, deps.DotStyle{
+			Label: func(pkg deps.Package) string {
+				return fmt.Sprintf("%s\\ndominates %d LOC in %d packages", pkg, graph.Info[pkg].ExclusiveLOC, dominated[pkg])
+			},
+			Unordered: *unordered,
+		}))
+	case "json":
+		type dominator struct {
+			Package           deps.Package `json:"package"`
+			Dominator         deps.Package `json:"dominator,omitempty"`
+			DominatedLOC      int          `json:"dominatedLoc"`
+			DominatedPackages int          `json:"dominatedPackages"`
+		}
+		result := struct {
+			Dominators []dominator `json:"dominators"`
+		}{[]dominator{}}
+		for _, pkg := range pkgs {
+			result.Dominators = append(result.Dominators, dominator{pkg, idom[pkg], graph.Info[pkg].ExclusiveLOC, dominated[pkg]})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// loadSymbols type checks the importing packages of the imports in the result, and records the
+// symbols they use in the graph's edge metadata.
+func loadSymbols(graph deps.Dependencies, wd string, result deps.Graph) error {
+	var edges []deps.Edge
+	for pkg, imports := range result {
+		for imp := range imports {
+			edges = append(edges, deps.Edge{From: pkg, To: imp})
+		}
+	}
+	env, buildFlags := goCommandConfig("", flagPlatform())
+	loader := &deps.SymbolLoader{
+		Config: packages.Config{Dir: wd, Env: env, BuildFlags: buildFlags},
+		Tests:  *includeTests,
+	}
+	symbols, err := loader.Load(edges)
+	if err != nil {
+		return fmt.Errorf("unable to load symbols: %v", err)
+	}
+	for edge, uses := range symbols {
+		info, ok := graph.EdgeInfo[edge]
+		if !ok {
+			info = &deps.EdgeInfo{}
+			graph.EdgeInfo[edge] = info
+		}
+		info.Symbols = uses
+	}
+	return nil
+}
+
+// printSymbols lists the symbols used by each import in the result, in the order their importers
+// are listed.
+func printSymbols(graph deps.Dependencies, roots []deps.Package, result deps.Graph) {
+	fmt.Println("Symbols:")
+	for _, pkg := range listPackages(result, roots) {
+		for _, imp := range result[pkg].Sorted() {
+			info := graph.EdgeInfo[deps.Edge{From: pkg, To: imp}]
+			if info == nil || len(info.Symbols) == 0 {
+				fmt.Printf("  %s -> %s: no exported symbols used\n", pkg, imp)
+				continue
+			}
+			fmt.Printf("  %s -> %s:\n", pkg, imp)
+			for _, s := range info.Symbols {
+				fmt.Printf("    %s (%s)\n", s.Symbol, joinPositions(s.Uses))
+			}
+		}
+	}
+}
+
+// printPathResult prints the result of a path query. With -k, list output numbers each path
+// separately.
+func printPathResult(graph deps.Dependencies, roots []deps.Package, result deps.Graph, paths []deps.Path) {
+	if *whySymbols && *output == "list" {
+		defer printSymbols(graph, roots, result)
+	}
+	if *kPaths == 0 || *output != "list" {
+		printResult(graph, roots, result, nil)
+		return
+	}
+	for i, path := range paths {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Path %d:\n", i+1)
+		for _, pkg := range path {
+			if *showLinesOfCode {
+				fmt.Printf("  %s (%d)\n", pkg, graph.Info[pkg].LOC)
+			} else {
+				fmt.Printf("  %s\n", pkg)
+			}
+		}
+	}
+}
+
+// buildGraph builds the dependency graph of the -from packages, resolving them relative to
+// wd. If gopath is set, it replaces GOPATH.
+func buildGraph(wd, gopath string, platform deps.Platform) (deps.Dependencies, deps.Loader, error) {
+	loader, err := newLoader(wd, gopath, platform)
+	if err != nil {
+		return deps.Dependencies{}, nil, err
+	}
+
+	// All roots share the vendor directories of the first package, so patterns are resolved
+	// after it.
+	var fromPkgs []deps.Package
+	baseDir := wd
+	for _, f := range from {
+		if deps.IsPattern(f) {
+			continue
+		}
+		fromPkg, dir, err := resolveSource(f, wd, loader)
+		if err != nil {
+			return deps.Dependencies{}, nil, err
+		}
+		if len(fromPkgs) == 0 {
+			baseDir = dir
+		}
+		fromPkgs = append(fromPkgs, fromPkg)
+	}
+	var roots []deps.Package
+	resolved := 0
+	for _, f := range from {
+		if !deps.IsPattern(f) {
+			roots = append(roots, fromPkgs[resolved])
+			resolved++
+			continue
+		}
+		if build.IsLocalImport(f) && baseDir != wd {
+			// Local patterns are expanded relative to the base directory.
+			rel, err := filepath.Rel(baseDir, filepath.Join(wd, f))
+			if err != nil {
+				return deps.Dependencies{}, nil, err
+			}
+			f = filepath.ToSlash(rel)
+			if !strings.HasPrefix(f, ".") {
+				f = "./" + f
+			}
+		}
+		roots = append(roots, deps.Package(f))
 	}
 
 	builder := deps.Builder{
-		Roots:         []deps.Package{fromPkg},
+		Roots:         roots,
 		IncludeTests:  *includeTests,
+		RootTestsOnly: *rootTests,
 		IncludeStdlib: *includeStdlib,
-		BuildContext:  build.Default,
+		Loader:        loader,
 		BaseDir:       baseDir,
+		Jobs:          *jobs,
+	}
+	if builder.Jobs == 0 {
+		builder.Jobs = runtime.NumCPU()
+	}
+	if *cacheDir != "" {
+		builder.Cache = &deps.Cache{Dir: *cacheDir}
 	}
 
 	if *ignore != "" {
 		ignoreRegexp, err := regexp.Compile(*ignore)
 		if err != nil {
-			return err
+			return deps.Dependencies{}, nil, err
 		}
 		builder.Ignored = []*regexp.Regexp{ignoreRegexp}
 	}
@@ -85,83 +1144,184 @@ func run() error {
 	if *include != "" {
 		includeRegexp, err := regexp.Compile(*include)
 		if err != nil {
-			return err
+			return deps.Dependencies{}, nil, err
 		}
 		builder.Included = []*regexp.Regexp{includeRegexp}
 	}
 
 	graph, err := builder.Build()
 	if err != nil {
-		return err
+		return deps.Dependencies{}, nil, err
 	}
-
-	var result deps.Graph
-	var endCond func(deps.Package) bool
-	if toPkg != "" {
-		endCond = func(pkg deps.Package) bool {
-			return pkg == toPkg
-		}
-	} else if *toRegex != "" {
-		r := regexp.MustCompile(*toRegex)
-		endCond = func(pkg deps.Package) bool {
-			return r.MatchString(string(pkg))
-		}
-	}
-
-	if endCond != nil {
-		if *allPaths {
-			result = graph.Forward.AllPathsCond(fromPkg, endCond)
-		} else {
-			path := graph.Forward.SomePathCond(fromPkg, endCond)
-			result = deps.NewGraph()
-			result.AddPath(path)
-		}
-	} else {
-		result = graph.Forward
+	if len(graph.Roots) == 0 {
+		return deps.Dependencies{}, nil, fmt.Errorf("no root packages matched %v", []string(from))
 	}
+	return graph, loader, nil
+}
 
-	if result == nil || len(result) == 0 {
-		dst := string(toPkg)
-		if *toRegex != "" {
-			dst = *toRegex
-		}
-		fmt.Fprintf(os.Stderr, "No path found from %q to %q\n", fromPkg, dst)
-		os.Exit(1)
-	}
+// target is a query target, matching one or more packages.
+type target struct {
+	name string
+	cond func(deps.Package) bool
+}
 
+// printResult prints the result graph of a query on the dependency graph. Paths are only included
+// in JSON output.
+func printResult(graph deps.Dependencies, roots []deps.Package, result deps.Graph, paths []deps.JSONPath) {
+	info := graph.Info
 	switch *output {
 	case "list":
 		if *showLinesOfCode {
-			printListWithLOC(fromPkg, result, graph.Info)
+			printListWithLOC(roots, result, info)
 		} else {
-			printList(fromPkg, result)
+			printList(roots, result)
+		}
+		if *showImports {
+			printImports(graph, roots, result)
 		}
-		return nil
 	case "dot":
 		if *showLinesOfCode {
-			printDotWithLOC(fromPkg, result, graph.Info)
+			printDotWithLOC(roots, result, info, graph.EdgeInfo)
 		} else {
-			printDot(fromPkg, result)
+			printDot(roots, result, graph.EdgeInfo)
 		}
-		return nil
-	default:
-		return fmt.Errorf("Unknown output format %q", *output)
+	case "json":
+		printJSON(graph.NewJSONResult(roots, result, paths))
 	}
 }
 
 func validateFlags() error {
-	if *from == "" {
+	if len(from) == 0 && !(command == "diff" && isFile(*oldGraph) && isFile(*newGraph)) {
 		return errors.New("-from must be set")
 	}
 
-	if *allPaths && *to == "" && *toRegex == "" {
+	if *allPaths && len(to) == 0 && *toRegex == "" {
 		return errors.New("-all-paths requires a -to package")
 	}
 
-	if *to != "" && *toRegex != "" {
+	if *shortest && len(to) == 0 && *toRegex == "" {
+		return errors.New("-shortest requires a -to package")
+	}
+
+	if *shortest && *allPaths {
+		return errors.New("only one of -shortest and -all-paths may be set")
+	}
+
+	if *cacheDir != "" && (*loaderName != "build" || *packagesJSON != "") {
+		return errors.New("-cache-dir requires the build loader")
+	}
+
+	if *jobs < 0 {
+		return errors.New("-j must not be negative")
+	}
+
+	if *kPaths < 0 {
+		return errors.New("-k must not be negative")
+	}
+
+	if *kPaths != 0 && len(to) == 0 && *toRegex == "" {
+		return errors.New("-k requires a -to package")
+	}
+
+	if *rootTests && !*includeTests {
+		return errors.New("-root-tests requires -include-tests")
+	}
+
+	if *cut && len(to) == 0 {
+		return errors.New("-cut requires a -to package")
+	}
+
+	if *whySymbols && len(to) == 0 && *toRegex == "" {
+		return errors.New("-why-symbols requires a -to or -toregex package")
+	}
+
+	if *whySymbols && (*cut || *packagesJSON != "") {
+		return errors.New("-why-symbols can not be combined with -cut or -packages-json")
+	}
+
+	if *cut && (*allPaths || *shortest || *kPaths != 0) {
+		return errors.New("-cut can not be combined with -all-paths, -shortest or -k")
+	}
+
+	if *kPaths != 0 && (*allPaths || *shortest) {
+		return errors.New("-k can not be combined with -all-paths or -shortest")
+	}
+
+	if len(to) != 0 && *toRegex != "" {
 		return errors.New("only one of -to and -toregex may be set")
 	}
 
+	if *rdeps != "" && (len(to) != 0 || *toRegex != "") {
+		return errors.New("-rdeps can not be combined with -to or -toregex")
+	}
+
+	if *cycles && (len(to) != 0 || *toRegex != "" || *rdeps != "") {
+		return errors.New("-cycles can not be combined with -to, -toregex or -rdeps")
+	}
+
+	if *dominators && (len(to) != 0 || *toRegex != "" || *rdeps != "" || *cycles) {
+		return errors.New("-dominators can not be combined with -to, -toregex, -rdeps or -cycles")
+	}
+
+	if command == "check" && *rules == "" {
+		return errors.New("check requires a -rules file")
+	}
+
+	if *rules != "" && command != "check" {
+		return errors.New("-rules is only used by the check command")
+	}
+
+	if command == "check" && (len(to) != 0 || *toRegex != "" || *rdeps != "" || *cycles || *dominators) {
+		return errors.New("check can not be combined with -to, -toregex, -rdeps, -cycles or -dominators")
+	}
+
+	if *revOld != "" || *revNew != "" {
+		if command == "check" {
+			return errors.New("-rev-old and -rev-new can not be combined with check")
+		}
+		command = "diff"
+	}
+
+	if command == "diff" && *oldGraph == "" && *revOld == "" {
+		return errors.New("diff requires an -old directory or graph, or a -rev-old revision")
+	}
+
+	if *oldGraph != "" && *revOld != "" || *newGraph != "" && *revNew != "" {
+		return errors.New("-old and -new can not be combined with -rev-old and -rev-new")
+	}
+
+	if command != "diff" && (*oldGraph != "" || *newGraph != "" || *oldGOPATH != "" || *newGOPATH != "") {
+		return errors.New("-old, -new, -old-gopath and -new-gopath are only used by the diff command")
+	}
+
+	if command == "diff" && (len(to) != 0 || *toRegex != "" || *rdeps != "" || *cycles || *dominators) {
+		return errors.New("diff can not be combined with -to, -toregex, -rdeps, -cycles or -dominators")
+	}
+
+	if *baseline != "" && (command != "" || len(to) != 0 || *toRegex != "" || *rdeps != "" || *cycles || *dominators) {
+		return errors.New("-baseline can not be combined with check, diff, -to, -toregex, -rdeps, -cycles or -dominators")
+	}
+
+	if (*updateBaseline || *baselineEdges) && *baseline == "" {
+		return errors.New("-update-baseline and -baseline-edges require a -baseline file")
+	}
+
+	if *matrix != "" && (command != "" || *baseline != "" || len(to) != 0 || *toRegex != "" || *rdeps != "" || *cycles || *dominators) {
+		return errors.New("-matrix can not be combined with check, diff, -baseline, -to, -toregex, -rdeps, -cycles or -dominators")
+	}
+
+	if *matrix != "" && (*goos != "" || *goarch != "" || *packagesJSON != "") {
+		return errors.New("-matrix can not be combined with -goos, -goarch or -packages-json")
+	}
+
+	if *depth < 0 {
+		return errors.New("-depth must not be negative")
+	}
+
+	if *depth != 0 && *rdeps == "" {
+		return errors.New("-depth requires an -rdeps package")
+	}
+
 	if *toRegex != "" {
 		if _, err := regexp.Compile(*toRegex); err != nil {
 			return fmt.Errorf("invalid -toregex: %v", err)
@@ -175,51 +1335,276 @@ func validateFlags() error {
 	if *ignore != "" && *ignore == *include {
 		return errors.New("-include can not be the same as -ignore")
 	}
+
+	if *output != "list" && *output != "dot" && *output != "json" {
+		return fmt.Errorf("Unknown output format %q", *output)
+	}
 	return nil
 }
 
-func printList(root deps.Package, paths deps.Graph) {
+// listPackages lists the packages reachable from the roots, sorted unless -unordered is set.
+func listPackages(g deps.Graph, roots []deps.Package) []deps.Package {
+	if *unordered {
+		return g.ListUnordered(roots...)
+	}
+	return g.List(roots...)
+}
+
+func printList(roots []deps.Package, paths deps.Graph) {
 	fmt.Println("Packages:")
-	for _, pkg := range paths.List(root) {
+	for _, pkg := range listPackages(paths, roots) {
 		fmt.Printf("  %s\n", pkg)
 	}
 }
 
-func printListWithLOC(root deps.Package, paths deps.Graph, pkgInfo map[deps.Package]*deps.DependencyInfo) {
+func printListWithLOC(roots []deps.Package, paths deps.Graph, pkgInfo map[deps.Package]*deps.DependencyInfo) {
 	totalLOC := 0
 	fmt.Println("Packages:")
-	for _, pkg := range paths.List(root) {
-		fmt.Printf("%s (%d)\n", pkg, pkgInfo[pkg].LOC)
-		totalLOC +=  pkgInfo[pkg].LOC
+	for _, pkg := range listPackages(paths, roots) {
+		info := pkgInfo[pkg]
+		fmt.Printf("%s (%d, transitive %d, exclusive %d)\n", pkg, info.LOC, info.TransitiveLOC, info.ExclusiveLOC)
+		totalLOC += pkgInfo[pkg].LOC
 	}
 	fmt.Printf("\nTotal Lines Of Code: %d\n", totalLOC)
 }
 
-func printDot(root deps.Package, paths deps.Graph) {
-	labelFn := func(pkg deps.Package) string {
-		return fmt.Sprintf("%s", pkg)
+// printImports lists the imports in the graph, in the order their importers are listed.
+func printImports(graph deps.Dependencies, roots []deps.Package, paths deps.Graph) {
+	fmt.Println("Imports:")
+	for _, pkg := range listPackages(paths, roots) {
+		for _, imp := range paths[pkg].Sorted() {
+			printImport(graph, pkg, imp)
+		}
 	}
-	fmt.Println(paths.Dot(root, labelFn))
 }
 
-func printDotWithLOC(root deps.Package, paths deps.Graph, pkgInfo map[deps.Package]*deps.DependencyInfo) {
-	labelFn := func(pkg deps.Package) string {
-		return fmt.Sprintf("%s (%d)", pkg, pkgInfo[pkg].LOC)
+// printImport prints an import, with the positions of its import statements if known.
+func printImport(graph deps.Dependencies, from, to deps.Package) {
+	line := fmt.Sprintf("  %s -> %s", from, to)
+	if info, ok := graph.EdgeInfo[deps.Edge{From: from, To: to}]; ok {
+		if len(info.Positions) > 0 {
+			line += fmt.Sprintf(" (%s)", joinPositions(info.Positions))
+		}
+		if info.Constraint != "" {
+			line += fmt.Sprintf(" [%s]", info.Constraint)
+		}
+		if info.Kind != deps.ProdEdge {
+			line += fmt.Sprintf(" (%s)", info.Kind)
+		}
+		if *showLinesOfCode && info.ExclusiveLOC > 0 {
+			line += fmt.Sprintf(" (exclusive %d)", info.ExclusiveLOC)
+		}
 	}
-	fmt.Println(paths.Dot(root, labelFn))
+	fmt.Println(line)
+}
+
+func joinPositions(positions []deps.ImportPos) string {
+	var s []string
+	for _, pos := range positions {
+		s = append(s, pos.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func printDot(roots []deps.Package, paths deps.Graph, edgeInfo map[deps.Edge]*deps.EdgeInfo) {
+	fmt.Println(paths.DotStyled(roots, deps.DotStyle{
+		Label:     dotLabelFn(nil),
+		EdgeAttrs: dotEdgeAttrsFn(edgeInfo, false),
+		Unordered: *unordered,
+	}))
+}
+
+func printDotWithLOC(roots []deps.Package, paths deps.Graph, pkgInfo map[deps.Package]*deps.DependencyInfo, edgeInfo map[deps.Edge]*deps.EdgeInfo) {
+	fmt.Println(paths.DotStyled(roots, deps.DotStyle{
+		Label:     dotLabelFn(pkgInfo),
+		EdgeAttrs: dotEdgeAttrsFn(edgeInfo, true),
+		Unordered: *unordered,
+	}))
+}
+
+// dotEdgeAttrsFn returns the function giving imports in dot output a tooltip with the positions of
+// their import statements, the symbols used if they were loaded, their build constraint and the
+// lines of code only they pull in. Conditional imports are dashed, and with showLOC imports which
+// pull in code are labelled with its lines.
+func dotEdgeAttrsFn(edgeInfo map[deps.Edge]*deps.EdgeInfo, showLOC bool) func(from, to deps.Package) string {
+	return func(from, to deps.Package) string {
+		info, ok := edgeInfo[deps.Edge{From: from, To: to}]
+		if !ok {
+			return ""
+		}
+		var tooltip []string
+		if len(info.Positions) > 0 {
+			tooltip = append(tooltip, joinPositions(info.Positions))
+		}
+		if len(info.Symbols) > 0 {
+			var symbols []string
+			for _, s := range info.Symbols {
+				symbols = append(symbols, s.Symbol)
+			}
+			tooltip = append(tooltip, "uses "+strings.Join(symbols, ", "))
+		}
+		var attrs []string
+		if info.Constraint != "" {
+			tooltip = append(tooltip, "if "+info.Constraint)
+			attrs = append(attrs, `style="dashed"`)
+		}
+		if color, ok := edgeKindColors[info.Kind]; ok {
+			tooltip = append(tooltip, info.Kind.String()+" import")
+			attrs = append(attrs, fmt.Sprintf("color=%q", color))
+		}
+		if info.ExclusiveLOC > 0 {
+			tooltip = append(tooltip, fmt.Sprintf("exclusive %d", info.ExclusiveLOC))
+			if showLOC {
+				attrs = append(attrs, fmt.Sprintf(`label="%d"`, info.ExclusiveLOC))
+			}
+		}
+		return strings.Join(append(attrs, fmt.Sprintf("tooltip=%q", strings.Join(tooltip, "\n"))), ",")
+	}
+}
+
+// edgeKindColors are the colors of test imports in dot output.
+var edgeKindColors = map[deps.EdgeKind]string{
+	deps.TestEdge:  "orange",
+	deps.XTestEdge: "purple",
+}
+
+// dotLabelFn returns the function labelling packages in dot output, with their lines of code if
+// pkgInfo is set.
+func dotLabelFn(pkgInfo map[deps.Package]*deps.DependencyInfo) func(deps.Package) string {
+	if pkgInfo == nil {
+		return func(pkg deps.Package) string {
+			return fmt.Sprintf("%s", pkg)
+		}
+	}
+	return func(pkg deps.Package) string {
+		info := pkgInfo[pkg]
+		return fmt.Sprintf("%s (%d)\\ntransitive %d, exclusive %d", pkg, info.LOC, info.TransitiveLOC, info.ExclusiveLOC)
+	}
+}
+
+func printJSON(result *deps.JSONResult) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newLoader returns the package loader selected by the -loader and -packages-json flags. If gopath
+// is set, it replaces GOPATH.
+func newLoader(workingDir, gopath string, platform deps.Platform) (deps.Loader, error) {
+	if *packagesJSON != "" {
+		return readPackages(*packagesJSON)
+	}
+	bctx := platform.Context(build.Default)
+	if gopath != "" {
+		bctx.GOPATH = gopath
+	}
+	env, buildFlags := goCommandConfig(gopath, platform)
+	switch *loaderName {
+	case "build":
+		modules, err := loadModules(workingDir)
+		if err != nil {
+			return nil, err
+		}
+		if modules != nil {
+			return &deps.ModuleLoader{Modules: modules, Context: bctx}, nil
+		}
+		return &deps.BuildLoader{Context: bctx}, nil
+	case "packages":
+		return &deps.PackagesLoader{Config: packages.Config{Env: env, BuildFlags: buildFlags}, Tests: *includeTests}, nil
+	case "golist":
+		return &deps.GoListLoader{Env: env, Flags: buildFlags}, nil
+	default:
+		return nil, fmt.Errorf("Unknown loader %q", *loaderName)
+	}
+}
+
+// goCommandConfig returns the environment and build flags for running the go command with the GOPATH
+// and platform. The environment is nil if the current one can be used.
+func goCommandConfig(gopath string, platform deps.Platform) (env, buildFlags []string) {
+	if gopath != "" || platform.GOOS != "" || platform.GOARCH != "" {
+		env = os.Environ()
+		if gopath != "" {
+			env = append(env, "GOPATH="+gopath)
+		}
+		env = platform.Env(env)
+	}
+	if len(platform.Tags) != 0 {
+		buildFlags = []string{"-tags=" + strings.Join(platform.Tags, ",")}
+	}
+	return env, buildFlags
+}
+
+// flagPlatform returns the platform selected with -goos, -goarch and -tags.
+func flagPlatform() deps.Platform {
+	p := deps.Platform{GOOS: *goos, GOARCH: *goarch}
+	for _, tag := range strings.Split(*tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	return p
+}
+
+func readPackages(file string) (deps.Loader, error) {
+	if file == "-" {
+		return deps.ReadPackages(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return deps.ReadPackages(f)
+}
+
+// loadModules returns the build list of the module containing workingDir, or nil if godepq should
+// resolve packages through GOPATH. As with the go tool, GO111MODULE=off disables module mode.
+func loadModules(workingDir string) (*deps.Modules, error) {
+	if os.Getenv("GO111MODULE") == "off" || deps.FindModuleRoot(workingDir) == "" {
+		return nil, nil
+	}
+	return deps.LoadModules(workingDir, "")
+}
+
+// resolve resolves the import path, relative to workingDir if it is a local path.
+func resolve(importPath, workingDir string, loader deps.Loader) (deps.Package, error) {
+	switch l := loader.(type) {
+	case *deps.BuildLoader:
+		return deps.Resolve(importPath, workingDir, l.Context)
+	case *deps.ModuleLoader:
+		return l.Modules.Resolve(importPath, workingDir, l.Context)
+	}
+	pkg, err := loader.Load(importPath, workingDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %q: %v", importPath, err)
+	}
+	src, _ := deps.StripVendor(deps.Package(pkg.ImportPath))
+	return src, nil
 }
 
 // resolveSource resolves the import path, and determines the base directory to resolve future
 // imports from.
 // If the resolved import is vendored, then future imports should use the same vendored sources.
 // Otherwise, future imports should be resolved with the source's vendor directory.
-func resolveSource(importPath, workingDir string) (deps.Package, string, error) {
-	pkg, err := build.Default.Import(importPath, workingDir, build.FindOnly)
+// Only go/build searches vendor directories relative to the base directory; other loaders resolve
+// imports themselves.
+func resolveSource(importPath, workingDir string, loader deps.Loader) (deps.Package, string, error) {
+	l, ok := loader.(*deps.BuildLoader)
+	if !ok {
+		pkg, err := resolve(importPath, workingDir, loader)
+		return pkg, workingDir, err
+	}
+	pkg, err := l.Context.Import(importPath, workingDir, build.FindOnly)
 	if err != nil {
 		return "", "", fmt.Errorf("unable to resolve %q: %v", importPath, err)
 	}
 	src, vendored := deps.StripVendor(deps.Package(pkg.ImportPath))
-	if vendored {
+	if vendored || build.IsLocalImport(pkg.ImportPath) {
+		// Local packages outside of GOPATH keep their relative path, and must be loaded
+		// relative to the working directory.
 		return src, workingDir, nil
 	}
 	return src, pkg.Dir, nil
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/godepq/deps"
+	"github.com/stretchr/testify/assert"
+)
+
+const basePkg = "github.com/google/godepq/testdata"
+
+// captureStdout returns what f prints to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	out, err := ioutil.TempFile("", "godepq-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+	f()
+	data, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRunBaselineKeepsEdges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godepq-baseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string, update, edges bool) {
+		*baseline, *updateBaseline, *baselineEdges = file, update, edges
+	}(*baseline, *updateBaseline, *baselineEdges)
+	*baseline = filepath.Join(dir, "deps.lock")
+
+	graph := deps.Dependencies{Roots: []deps.Package{"a"}, Forward: deps.NewGraph()}
+	graph.Forward.Pkg("a").Insert("b")
+	graph.Forward.Pkg("b")
+	update := func(edges bool) {
+		*updateBaseline, *baselineEdges = true, edges
+		captureStdout(t, func() {
+			_, err := runBaseline(graph)
+			assert.NoError(t, err)
+		})
+	}
+	check := func() bool {
+		*updateBaseline, *baselineEdges = false, false
+		var ok bool
+		captureStdout(t, func() {
+			ok, err = runBaseline(graph)
+			assert.NoError(t, err)
+		})
+		return ok
+	}
+
+	// Updating an edge baseline without -baseline-edges keeps the edges.
+	update(true)
+	update(false)
+	graph.Forward.Pkg("b").Insert("a")
+	assert.False(t, check())
+
+	// A baseline without edges only fails for new packages.
+	assert.NoError(t, os.Remove(*baseline))
+	update(false)
+	assert.True(t, check())
+	graph.Forward.Pkg("b").Insert("c")
+	graph.Forward.Pkg("c")
+	assert.False(t, check())
+}
+
+func TestRunGroupsPathsByRootAndTarget(t *testing.T) {
+	defer func(oldFrom, oldTo listFlag) { from, to = oldFrom, oldTo }(from, to)
+	from = listFlag{"./testdata/a", "./testdata/b"}
+	to = listFlag{"./testdata/a/aa/aaa", "./testdata/b/ba"}
+	out := captureStdout(t, func() {
+		assert.NoError(t, run())
+	})
+	// Only the roots which reach a target have a group.
+	assert.Equal(t, `From "github.com/google/godepq/testdata/a" to "github.com/google/godepq/testdata/a/aa/aaa":
+Packages:
+  github.com/google/godepq/testdata/a
+  github.com/google/godepq/testdata/a/aa
+  github.com/google/godepq/testdata/a/aa/aaa
+
+From "github.com/google/godepq/testdata/b" to "github.com/google/godepq/testdata/b/ba":
+Packages:
+  github.com/google/godepq/testdata/b
+  github.com/google/godepq/testdata/b/ba
+`, out)
+}
+
+func TestRunJSONPaths(t *testing.T) {
+	defer func(oldFrom, oldTo listFlag, oldOutput string) {
+		from, to, *output = oldFrom, oldTo, oldOutput
+	}(from, to, *output)
+	from = listFlag{"./testdata/a", "./testdata/b"}
+	to = listFlag{"./testdata/a/aa/aaa", "./testdata/b/ba"}
+	*output = "json"
+	out := captureStdout(t, func() {
+		assert.NoError(t, run())
+	})
+	var result deps.JSONResult
+	if !assert.NoError(t, json.Unmarshal([]byte(out), &result)) {
+		return
+	}
+	// Each path records the root and target it was found for.
+	a, b := deps.Package(basePkg+"/a"), deps.Package(basePkg+"/b")
+	assert.Equal(t, []deps.JSONPath{
+		{From: a, To: basePkg + "/a/aa/aaa", Path: deps.Path{a, a + "/aa", a + "/aa/aaa"}},
+		{From: b, To: basePkg + "/b/ba", Path: deps.Path{b, b + "/ba"}},
+	}, result.Paths)
+}
@@ -0,0 +1,14 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package b_test
+
+import (
+	_ "github.com/google/godepq/testdata/b"
+	_ "github.com/google/godepq/testdata/c"
+)
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/godepq/deps"
+)
+
+// worktree is a checkout of a git revision in a temporary directory.
+type worktree struct {
+	// The directory in the checkout corresponding to the working directory.
+	dir string
+	// The GOPATH to build the checkout with, if it is in GOPATH.
+	gopath string
+
+	tmpDir   string
+	checkout string
+	repoDir  string
+}
+
+// checkoutRevision checks out the revision of the git repository containing workingDir into a
+// temporary worktree, which must be removed when done.
+//
+// In GOPATH mode, packages in the repository must resolve to the checkout rather than to the
+// repository itself, so the checkout is placed in a temporary GOPATH which precedes the current
+// one.
+func checkoutRevision(workingDir, rev string) (*worktree, error) {
+	top, err := git(workingDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the git repository of %s: %v", workingDir, err)
+	}
+	prefix, err := git(workingDir, "rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir("", "godepq")
+	if err != nil {
+		return nil, err
+	}
+	w := &worktree{tmpDir: tmpDir, repoDir: top}
+
+	w.checkout = filepath.Join(tmpDir, "checkout")
+	if os.Getenv("GO111MODULE") == "off" || deps.FindModuleRoot(workingDir) == "" {
+		if pkg, err := build.Default.ImportDir(top, build.FindOnly); err == nil && !build.IsLocalImport(pkg.ImportPath) {
+			gopath := filepath.Join(tmpDir, "gopath")
+			w.checkout = filepath.Join(gopath, "src", filepath.FromSlash(pkg.ImportPath))
+			w.gopath = gopath + string(filepath.ListSeparator) + build.Default.GOPATH
+			if err := os.MkdirAll(filepath.Dir(w.checkout), 0755); err != nil {
+				w.remove()
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := git(top, "worktree", "add", "--detach", w.checkout, rev); err != nil {
+		w.remove()
+		return nil, err
+	}
+	w.dir = filepath.Join(w.checkout, filepath.FromSlash(prefix))
+	return w, nil
+}
+
+// remove deletes the worktree. The repository's record of the worktree is pruned even if the
+// checkout was already deleted.
+func (w *worktree) remove() {
+	if _, err := os.Stat(w.checkout); err == nil {
+		if _, err := git(w.repoDir, "worktree", "remove", "--force", w.checkout); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	os.RemoveAll(w.tmpDir)
+	if _, err := git(w.repoDir, "worktree", "prune"); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+}
+
+// git runs a git command in dir, and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRepo creates a git repository of a module with two commits, returning its directory and
+// the first commit. The temporary directory is set to an empty directory under it, so that tests
+// can check nothing is left in it. The returned function deletes everything.
+func newRepo(t *testing.T) (string, string, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "godepq-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTmp := os.Getenv("TMPDIR")
+	cleanup := func() {
+		os.Setenv("TMPDIR", oldTmp)
+		os.RemoveAll(dir)
+	}
+	// Resolve symlinks, so that paths match those reported by git.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	repo := filepath.Join(dir, "repo")
+	tmp := filepath.Join(dir, "tmp")
+	for _, d := range []string{filepath.Join(repo, "p"), filepath.Join(repo, "q"), tmp} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("TMPDIR", tmp)
+
+	write := func(file, content string) {
+		if err := ioutil.WriteFile(filepath.Join(repo, file), []byte(content), 0644); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	run := func(args ...string) string {
+		out, err := git(repo, args...)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return out
+	}
+	run("init", "-q")
+	run("config", "user.name", "test")
+	run("config", "user.email", "test@example.com")
+	write("go.mod", "module example.com/r\n")
+	write("p/p.go", "package p\n\nimport \"example.com/r/q\"\n")
+	write("q/q.go", "package q\n")
+	write("r.go", "package r\n\nimport \"example.com/r/p\"\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "first")
+	first := run("rev-parse", "HEAD")
+	write("p/p.go", "package p\n")
+	run("commit", "-q", "-a", "-m", "second")
+	return repo, first, cleanup
+}
+
+// assertNoWorktrees checks that no worktrees of the repository are left, and that the temporary
+// directory is empty.
+func assertNoWorktrees(t *testing.T, repo string) {
+	out, err := git(repo, "worktree", "list", "--porcelain")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, strings.Count(out, "worktree "), out)
+	}
+	files, err := ioutil.ReadDir(os.Getenv("TMPDIR"))
+	if assert.NoError(t, err) {
+		assert.Empty(t, files)
+	}
+}
+
+func TestCheckoutRevision(t *testing.T) {
+	repo, first, cleanup := newRepo(t)
+	defer cleanup()
+
+	w, err := checkoutRevision(filepath.Join(repo, "p"), first)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The checkout is detached at the revision, in the directory matching the working directory.
+	assert.Equal(t, "p", filepath.Base(w.dir))
+	data, err := ioutil.ReadFile(filepath.Join(w.dir, "p.go"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(data), "example.com/r/q")
+	}
+	head, err := git(w.dir, "rev-parse", "HEAD")
+	if assert.NoError(t, err) {
+		assert.Equal(t, first, head)
+	}
+	_, err = git(w.dir, "symbolic-ref", "-q", "HEAD")
+	assert.Error(t, err, "HEAD is not detached")
+	branch, err := git(repo, "rev-parse", "--abbrev-ref", "HEAD")
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, "HEAD", branch)
+	}
+
+	w.remove()
+	assertNoWorktrees(t, repo)
+
+	// The record of a checkout which was deleted is pruned.
+	w, err = checkoutRevision(repo, "HEAD")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, os.RemoveAll(w.checkout))
+	w.remove()
+	assertNoWorktrees(t, repo)
+}
+
+func TestCheckoutRevisionErrors(t *testing.T) {
+	repo, _, cleanup := newRepo(t)
+	defer cleanup()
+
+	_, err := checkoutRevision(repo, "no-such-revision")
+	assert.Error(t, err)
+	assertNoWorktrees(t, repo)
+
+	outside := filepath.Join(filepath.Dir(repo), "outside")
+	if !assert.NoError(t, os.Mkdir(outside, 0755)) {
+		return
+	}
+	os.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(repo))
+	defer os.Unsetenv("GIT_CEILING_DIRECTORIES")
+	_, err = checkoutRevision(outside, "HEAD")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to find the git repository of "+outside)
+	}
+	files, err := ioutil.ReadDir(os.Getenv("TMPDIR"))
+	if assert.NoError(t, err) {
+		assert.Empty(t, files)
+	}
+}
+
+func TestLoadSideRevision(t *testing.T) {
+	repo, first, cleanup := newRepo(t)
+	defer cleanup()
+	oldFrom := from
+	defer func() { from = oldFrom }()
+
+	// The graph is built from the revision.
+	from = listFlag{"."}
+	graph, err := loadSide(repo, "", "", first)
+	if assert.NoError(t, err) {
+		assert.True(t, graph.Forward["example.com/r/p"].Has("example.com/r/q"))
+	}
+	assertNoWorktrees(t, repo)
+	graph, err = loadSide(repo, "", "", "HEAD")
+	if assert.NoError(t, err) {
+		assert.False(t, graph.Forward["example.com/r/p"].Has("example.com/r/q"))
+	}
+	assertNoWorktrees(t, repo)
+
+	// The worktree is removed if the graph can not be built.
+	from = listFlag{"example.com/r/missing"}
+	_, err = loadSide(repo, "", "", first)
+	assert.Error(t, err)
+	assertNoWorktrees(t, repo)
+}